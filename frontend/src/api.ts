@@ -2,28 +2,53 @@ import type { PipelineResponse, PipelineUpdateRequest, ProcessRequestBody } from
 
 const base = '' // same origin when served by Go
 
+// ETag of the pipeline config last read or written; sent as If-Match so concurrent edits are rejected (412).
+let pipelineETag = '*'
+
 export async function getPipeline(): Promise<PipelineResponse> {
   const res = await fetch(`${base}/api/pipeline`)
   if (!res.ok) throw new Error(res.statusText)
+  pipelineETag = res.headers.get('ETag') ?? '*'
   return res.json()
 }
 
 export async function putPipeline(
   body: PipelineUpdateRequest
-): Promise<{ ok: boolean; saved?: boolean; detail?: string }> {
+): Promise<{ ok: boolean; saved?: boolean; version?: number; detail?: string }> {
   const res = await fetch(`${base}/api/pipeline`, {
     method: 'PUT',
-    headers: { 'Content-Type': 'application/json' },
+    headers: { 'Content-Type': 'application/json', 'If-Match': pipelineETag },
     body: JSON.stringify(body),
   })
+  const etag = res.headers.get('ETag')
+  if (etag) pipelineETag = etag
   return res.json()
 }
 
+// subscribePipelineChanges calls onChange whenever the gateway reports a pipeline_changed event
+// (file edited, or another client saved). Returns a function that closes the stream.
+export function subscribePipelineChanges(onChange: () => void): () => void {
+  const source = new EventSource(`${base}/api/pipeline/events`)
+  source.addEventListener('pipeline_changed', () => onChange())
+  return () => source.close()
+}
+
 export type SSEEvent = 
-  | { event: 'started'; data: { trace_id: string; payload: unknown } }
-  | { event: 'step'; data: { service: string; input?: string; output?: string; status?: string; payload_type?: string } }
-  | { event: 'error'; data: { service: string; error: string } }
-  | { event: 'done'; data: { trace_id: string; result?: unknown; steps?: unknown[]; payload?: Record<string, unknown> } }
+  | { event: 'started'; data: { trace_id: string; trace_url?: string; payload: unknown } }
+  | { event: 'step'; data: { service: string; input?: string; output?: string; status?: string; payload_type?: string; pipeline?: string; parent?: string; variant?: string; fallback?: string; error?: string } }
+  | { event: 'error'; data: { service: string; error: string; status?: string; outcomes?: StepOutcome[]; steps?: unknown[]; dead_letter_id?: string } }
+  | { event: 'done'; data: { trace_id: string; trace_url?: string; status?: string; result?: unknown; steps?: unknown[]; payload?: Record<string, unknown>; outcomes?: StepOutcome[] } }
+
+/** How one service of a run ended: ok, fallback, skipped, continued, failed, dead_letter or not_run. */
+export interface StepOutcome {
+  service: string
+  pipeline?: string
+  status: string
+  variant?: string
+  error?: string
+  duration_ms: number
+  compensation?: 'compensated' | 'failed'
+}
 
 export async function processStream(
   body: ProcessRequestBody,
@@ -1,4 +1,27 @@
-export interface PipelineService {
+/** Service settings the editor does not show; they are sent back unchanged on save. */
+export interface ServiceRouting {
+  pipeline?: string
+  include?: string
+  endpoints?: string[]
+  balance?: string
+  hash_key?: string
+  variants?: ServiceVariant[]
+  sticky_key?: string
+  shadow?: string
+  hedge?: { percentile?: number; delay?: string; max?: number }
+  fallback?: { url?: string; payload?: Record<string, unknown>; pass_through?: boolean }
+  on_error?: 'abort' | 'skip' | 'continue' | 'dead_letter'
+  compensate?: string
+}
+
+export interface ServiceVariant {
+  name: string
+  url: string
+  weight: number
+  match?: { headers?: Record<string, string>; metadata?: Record<string, string> }
+}
+
+export interface PipelineService extends ServiceRouting {
   name: string
   url: string
   icon: string
@@ -12,7 +35,7 @@ export interface PipelineResponse {
 }
 
 export interface PipelineUpdateRequest {
-  services: Array<{
+  services: Array<ServiceRouting & {
     name: string
     url: string
     icon?: string
@@ -36,6 +59,7 @@ export interface SSEStep {
 
 export interface SSEDone {
   trace_id: string
+  trace_url?: string
   result?: unknown
   steps?: unknown[]
   payload?: Record<string, unknown>
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// baggageMapping maps a request header or payload.metadata key to a baggage key.
+type baggageMapping struct {
+	From string
+	Key  string
+}
+
+// BaggageConfig is the allowlist of request values the gateway copies into baggage for downstream services.
+type BaggageConfig struct {
+	Headers        []baggageMapping
+	MetadataKeys   []baggageMapping
+	IdentityHeader string // header set by an auth proxy carrying the authenticated user
+	IdentityKey    string
+	// IdentityBasicAuth uses the basic-auth user when IdentityHeader is unset. The gateway does not check
+	// the password, so only enable it behind a proxy that does.
+	IdentityBasicAuth bool
+}
+
+// parseBaggageMappings parses "from=key,from2" lists. Without "=", the baggage key is the lowercased source name.
+func parseBaggageMappings(s string) []baggageMapping {
+	var out []baggageMapping
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, key, ok := strings.Cut(part, "=")
+		from = strings.TrimSpace(from)
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			key = strings.ToLower(from)
+		}
+		out = append(out, baggageMapping{From: from, Key: key})
+	}
+	return out
+}
+
+func loadBaggageConfig() BaggageConfig {
+	key := os.Getenv("BAGGAGE_IDENTITY_KEY")
+	if key == "" {
+		key = "enduser.id"
+	}
+	return BaggageConfig{
+		Headers:           parseBaggageMappings(os.Getenv("BAGGAGE_FROM_HEADERS")),
+		MetadataKeys:      parseBaggageMappings(os.Getenv("BAGGAGE_FROM_METADATA")),
+		IdentityHeader:    strings.TrimSpace(os.Getenv("BAGGAGE_IDENTITY_HEADER")),
+		IdentityKey:       key,
+		IdentityBasicAuth: strings.ToLower(os.Getenv("BAGGAGE_IDENTITY_BASIC_AUTH")) == "true",
+	}
+}
+
+var baggageConfig = loadBaggageConfig()
+
+// Entries returns the allowlisted baggage entries for a run. Metadata is applied first, then headers,
+// then the identity, so values from the client payload cannot override ones from the proxy's headers.
+func (c BaggageConfig) Entries(r *http.Request, payload map[string]interface{}) map[string]string {
+	out := map[string]string{}
+	meta, _ := payload["metadata"].(map[string]interface{})
+	for _, m := range c.MetadataKeys {
+		if v, ok := meta[m.From]; ok && v != nil {
+			if s := strings.TrimSpace(fmt.Sprint(v)); s != "" {
+				out[m.Key] = s
+			}
+		}
+	}
+	for _, m := range c.Headers {
+		if v := strings.TrimSpace(r.Header.Get(m.From)); v != "" {
+			out[m.Key] = v
+		}
+	}
+	if c.IdentityHeader != "" {
+		if v := strings.TrimSpace(r.Header.Get(c.IdentityHeader)); v != "" {
+			out[c.IdentityKey] = v
+		}
+	} else if user, _, ok := r.BasicAuth(); ok && user != "" && c.IdentityBasicAuth {
+		out[c.IdentityKey] = user
+	}
+	return out
+}
+
+// withRunBaggage adds the allowlisted entries to ctx's baggage (injected into service calls by postWithTrace)
+// and records them as attributes on the current span.
+func withRunBaggage(ctx context.Context, r *http.Request, payload map[string]interface{}) context.Context {
+	entries := baggageConfig.Entries(r, payload)
+	if len(entries) == 0 {
+		return ctx
+	}
+	bag := baggage.FromContext(ctx)
+	attrs := make([]attribute.KeyValue, 0, len(entries))
+	for k, v := range entries {
+		member, err := baggage.NewMemberRaw(k, v)
+		if err != nil {
+			logger.WarnContext(ctx, "skipping invalid baggage entry", "key", k, "error", err)
+			continue
+		}
+		next, err := bag.SetMember(member)
+		if err != nil {
+			logger.WarnContext(ctx, "skipping invalid baggage entry", "key", k, "error", err)
+			continue
+		}
+		bag = next
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+	return baggage.ContextWithBaggage(ctx, bag)
+}
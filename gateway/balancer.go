@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Load balancing strategies for services with several endpoints.
+const (
+	balanceRoundRobin       = "round_robin"
+	balanceLeastOutstanding = "least_outstanding"
+	balanceConsistentHash   = "consistent_hash"
+)
+
+// hashReplicas is the number of points per endpoint on the consistent-hash ring.
+const hashReplicas = 64
+
+func validBalance(s string) bool {
+	switch s {
+	case "", balanceRoundRobin, balanceLeastOutstanding, balanceConsistentHash:
+		return true
+	}
+	return false
+}
+
+// endpointURLs returns the configured URLs of s: url (if set) followed by endpoints, without duplicates.
+// Discovery URLs are returned as they are; the balancer expands them.
+func (s PipelineService) endpointURLs() []string {
+	seen := make(map[string]bool, len(s.Endpoints)+1)
+	var out []string
+	for _, u := range append([]string{s.URL}, s.Endpoints...) {
+		u = strings.TrimRight(u, "/")
+		if u != "" && !seen[u] {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// balanceKey returns the payload metadata value consistent hashing routes on ("" = not hashed).
+func balanceKey(s PipelineService, payload map[string]interface{}) string {
+	if s.Balance != balanceConsistentHash || s.HashKey == "" {
+		return ""
+	}
+	meta, _ := payload["metadata"].(map[string]interface{})
+	if v, ok := meta[s.HashKey]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// endpoint is one base URL of a service plus what the balancer knows about it. Its circuit breaker key
+// is the URL.
+type endpoint struct {
+	url          string
+	outstanding  int       // requests sent and not yet finished
+	failures     int       // consecutive failures, for outlier ejection
+	ejections    int       // times ejected; each ejection lasts longer
+	ejectedUntil time.Time // zero = not ejected
+}
+
+// balancer picks the endpoint for each call to one service. specs are the service's URLs as configured;
+// discovery URLs among them are expanded into endpoints on every pick (see discovery.go), before taking mu
+// since the first use of a source waits for its lookup.
+type balancer struct {
+	mu        sync.Mutex
+	service   string
+	strategy  string
+	specs     []string
+	endpoints []*endpoint
+	ring      []ringPoint // consistent hash ring, sorted by hash
+	next      int         // round robin cursor
+	budget    *retryBudget
+	latencies latencyWindow // for percentile hedge delays
+}
+
+type ringPoint struct {
+	hash uint32
+	ep   *endpoint
+}
+
+func newBalancer(service, strategy string, specs []string) *balancer {
+	return &balancer{service: service, strategy: strategy, specs: specs, budget: newRetryBudget()}
+}
+
+// resolve returns the endpoints b.specs currently expand to. Caller must not hold b.mu.
+func (b *balancer) resolve() []string {
+	b.mu.Lock()
+	specs := b.specs
+	b.mu.Unlock()
+	return resolveEndpoints(specs)
+}
+
+// sync updates b.endpoints to urls (from resolve), keeping the state of endpoints that stay. Caller must
+// hold b.mu.
+func (b *balancer) sync(urls []string) {
+	if len(urls) == len(b.endpoints) {
+		same := true
+		for i, ep := range b.endpoints {
+			if ep.url != urls[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+	old := make(map[string]*endpoint, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		old[ep.url] = ep
+	}
+	b.endpoints = b.endpoints[:0:0]
+	for _, u := range urls {
+		ep, ok := old[u]
+		if !ok {
+			ep = &endpoint{url: u}
+		}
+		b.endpoints = append(b.endpoints, ep)
+	}
+	b.buildRing()
+}
+
+// urls returns the endpoints b currently balances over.
+func (b *balancer) urls() []string {
+	urls := b.resolve()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sync(urls)
+	out := make([]string, len(b.endpoints))
+	for i, ep := range b.endpoints {
+		out[i] = ep.url
+	}
+	return out
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// buildRing rebuilds the consistent hash ring from b.endpoints. Caller must hold b.mu (or own b).
+func (b *balancer) buildRing() {
+	b.ring = b.ring[:0]
+	if b.strategy != balanceConsistentHash {
+		return
+	}
+	for _, ep := range b.endpoints {
+		for i := 0; i < hashReplicas; i++ {
+			b.ring = append(b.ring, ringPoint{hash: hash32(ep.url + "#" + strconv.Itoa(i)), ep: ep})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+}
+
+// eligible reports whether ep may be picked: not tried and not ejected. Its circuit is asked separately
+// (see pick). Caller must hold b.mu.
+func (b *balancer) eligible(ep *endpoint, now time.Time, tried map[string]bool) bool {
+	return !tried[ep.url] && !now.Before(ep.ejectedUntil)
+}
+
+// pick chooses an endpoint not in tried, or returns nil when none is available. With consistent hashing
+// and a non-empty key the same key keeps going to the same endpoint while it is available.
+//
+// Each strategy orders the eligible endpoints and the circuit breaker is asked only for the one about to
+// be chosen, moving on to the next when it refuses: on a half-open circuit Allow hands out the single
+// trial call, which would be lost on an endpoint that is then not called.
+func (b *balancer) pick(ctx context.Context, key string, tried map[string]bool) *endpoint {
+	urls := b.resolve()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sync(urls)
+	now := time.Now()
+	n := len(b.endpoints)
+	if n == 0 {
+		return nil
+	}
+	var ep *endpoint
+	switch {
+	case b.strategy == balanceConsistentHash && key != "" && len(b.ring) > 0:
+		h := hash32(key)
+		start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+		refused := make(map[*endpoint]bool)
+		for i := 0; i < len(b.ring); i++ {
+			p := b.ring[(start+i)%len(b.ring)]
+			if refused[p.ep] || !b.eligible(p.ep, now, tried) {
+				continue
+			}
+			if circuitBreaker.Allow(ctx, p.ep.url) {
+				ep = p.ep
+				break
+			}
+			refused[p.ep] = true
+		}
+	case b.strategy == balanceLeastOutstanding:
+		// Start at the cursor so ties rotate instead of always hitting the first endpoint.
+		var candidates []*endpoint
+		for i := 0; i < n; i++ {
+			if c := b.endpoints[(b.next+i)%n]; b.eligible(c, now, tried) {
+				candidates = append(candidates, c)
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].outstanding < candidates[j].outstanding })
+		for _, c := range candidates {
+			if circuitBreaker.Allow(ctx, c.url) {
+				ep = c
+				break
+			}
+		}
+		b.next++
+	default:
+		for i := 0; i < n; i++ {
+			c := b.endpoints[(b.next+i)%n]
+			if b.eligible(c, now, tried) && circuitBreaker.Allow(ctx, c.url) {
+				ep = c
+				b.next = (b.next + i + 1) % n
+				break
+			}
+		}
+	}
+	if ep != nil {
+		ep.outstanding++
+	}
+	return ep
+}
+
+// done records the outcome of a call to ep. Consecutive failures eject ep for
+// PIPELINE_OUTLIER_EJECTION_SEC times its ejection count, unless that would eject more than
+// PIPELINE_OUTLIER_MAX_EJECTION_PERCENT of the endpoints.
+func (b *balancer) done(ctx context.Context, ep *endpoint, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ep.outstanding--
+	if !failed {
+		ep.failures = 0
+		return
+	}
+	ep.failures++
+	if clientConfig.OutlierFailures <= 0 || ep.failures < clientConfig.OutlierFailures {
+		return
+	}
+	now := time.Now()
+	ejected := 0
+	for _, e := range b.endpoints {
+		if now.Before(e.ejectedUntil) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > len(b.endpoints)*clientConfig.OutlierMaxPercent {
+		return
+	}
+	ep.ejections++
+	ep.failures = 0
+	ep.ejectedUntil = now.Add(time.Duration(ep.ejections) * clientConfig.OutlierEjection)
+	logger.WarnContext(ctx, "endpoint ejected", "service", b.service, "endpoint", ep.url, "until", ep.ejectedUntil, "ejections", ep.ejections)
+}
+
+// release gives back a pick of ep whose call has no outcome: it was never sent, or it was cancelled because
+// another hedge won. It must not reset ep.failures, or a slow endpoint that keeps losing hedges would never
+// be ejected.
+func (b *balancer) release(ep *endpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ep.outstanding--
+}
+
+// releaseBody calls release once when the response body is closed, so least_outstanding counts a call
+// until its response has been read.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseBody) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// balancers holds one balancer per service definition, so endpoint state survives between runs. Balancers
+// of definitions the config no longer has are dropped (see pruneBalancers).
+var balancers = struct {
+	sync.Mutex
+	byKey map[string]*balancer
+}{byKey: make(map[string]*balancer)}
+
+// balancerKey returns what balancerFor caches the balancer of s under: services with the same name,
+// endpoints and strategy share one.
+func balancerKey(s PipelineService) (key, strategy string, urls []string) {
+	urls = s.endpointURLs()
+	strategy = s.Balance
+	if strategy == "" {
+		strategy = balanceRoundRobin
+	}
+	return s.Name + "|" + strategy + "|" + strings.Join(urls, ","), strategy, urls
+}
+
+// balancerFor returns the balancer for s.
+func balancerFor(s PipelineService) *balancer {
+	key, strategy, urls := balancerKey(s)
+	balancers.Lock()
+	defer balancers.Unlock()
+	b, ok := balancers.byKey[key]
+	if !ok {
+		b = newBalancer(s.Name, strategy, urls)
+		balancers.byKey[key] = b
+	}
+	return b
+}
+
+// balancedTargets returns every service definition s may call through a balancer: s itself, its variants,
+// its fallback url and its compensate URL.
+func balancedTargets(s PipelineService) []PipelineService {
+	out := []PipelineService{s}
+	for _, v := range s.Variants {
+		out = append(out, variantTarget(s, v))
+	}
+	if s.Fallback != nil && s.Fallback.URL != "" {
+		out = append(out, fallbackTarget(s))
+	}
+	if s.Compensate != "" {
+		out = append(out, compensateTarget(s))
+	}
+	return out
+}
+
+// pruneBalancers drops the balancers of service definitions that are not in ps. It runs once per config
+// change, when ps replaces the current config (see savePipelineSet and loadPipelineSet); a run still using
+// the older config gets a new balancer for its next call, dropped again at the next change.
+func pruneBalancers(ps *pipelineSet) {
+	keep := make(map[string]bool)
+	for name, svc := range ps.Pipelines {
+		if r, ok := ps.resolved[name]; ok {
+			svc = r // as ResolvePipeline
+		}
+		for _, s := range svc {
+			for _, t := range balancedTargets(s) {
+				key, _, _ := balancerKey(t)
+				keep[key] = true
+			}
+		}
+	}
+	balancers.Lock()
+	defer balancers.Unlock()
+	for key := range balancers.byKey {
+		if !keep[key] {
+			delete(balancers.byKey, key)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBalancer returns a balancer over http://<name> for each name, with its endpoints synced, and gives
+// the test its own circuit breaker (threshold 1, so one Failure opens a circuit).
+func testBalancer(t *testing.T, strategy string, cooldown time.Duration, names ...string) *balancer {
+	t.Helper()
+	old := circuitBreaker
+	circuitBreaker = NewCircuitBreaker(1, time.Minute, cooldown)
+	t.Cleanup(func() { circuitBreaker = old })
+	var specs []string
+	for _, n := range names {
+		specs = append(specs, "http://"+n)
+	}
+	b := newBalancer("svc", strategy, specs)
+	b.urls()
+	return b
+}
+
+// withOutlierConfig sets the outlier ejection settings for the test.
+func withOutlierConfig(t *testing.T, failures, maxPercent int) {
+	t.Helper()
+	old := clientConfig
+	clientConfig.OutlierFailures, clientConfig.OutlierEjection, clientConfig.OutlierMaxPercent = failures, time.Minute, maxPercent
+	t.Cleanup(func() { clientConfig = old })
+}
+
+// endpointNamed returns the endpoint of b for http://<name>.
+func endpointNamed(t *testing.T, b *balancer, name string) *endpoint {
+	t.Helper()
+	for _, ep := range b.endpoints {
+		if ep.url == "http://"+name {
+			return ep
+		}
+	}
+	t.Fatalf("no endpoint %s", name)
+	return nil
+}
+
+func TestBalancerPick(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		strategy string
+		setup    func(t *testing.T, b *balancer)
+		tried    []string
+		want     []string // successive picks, "" = none available
+	}{
+		{name: "round robin rotates", strategy: balanceRoundRobin, want: []string{"a", "b", "c", "a"}},
+		{
+			name:     "round robin skips ejected endpoints",
+			strategy: balanceRoundRobin,
+			setup:    func(t *testing.T, b *balancer) { endpointNamed(t, b, "b").ejectedUntil = time.Now().Add(time.Minute) },
+			want:     []string{"a", "c", "a"},
+		},
+		{
+			name:     "expired ejection",
+			strategy: balanceRoundRobin,
+			setup:    func(t *testing.T, b *balancer) { endpointNamed(t, b, "b").ejectedUntil = time.Now().Add(-time.Second) },
+			want:     []string{"a", "b", "c"},
+		},
+		{name: "round robin skips tried endpoints", strategy: balanceRoundRobin, tried: []string{"a"}, want: []string{"b", "c", "b"}},
+		{
+			name:     "round robin skips open circuits",
+			strategy: balanceRoundRobin,
+			setup:    func(t *testing.T, b *balancer) { circuitBreaker.Failure(ctx, "http://a") },
+			want:     []string{"b", "c", "b"},
+		},
+		{name: "none available", strategy: balanceRoundRobin, tried: []string{"a", "b", "c"}, want: []string{""}},
+		{name: "least outstanding rotates ties", strategy: balanceLeastOutstanding, want: []string{"a", "b", "c", "a"}},
+		{
+			name:     "least outstanding picks the fewest",
+			strategy: balanceLeastOutstanding,
+			setup: func(t *testing.T, b *balancer) {
+				endpointNamed(t, b, "a").outstanding = 2
+				endpointNamed(t, b, "c").outstanding = 1
+			},
+			want: []string{"b", "b", "c"},
+		},
+		{
+			name:     "least outstanding skips open circuits",
+			strategy: balanceLeastOutstanding,
+			setup: func(t *testing.T, b *balancer) {
+				endpointNamed(t, b, "b").outstanding = 1
+				endpointNamed(t, b, "c").outstanding = 2
+				circuitBreaker.Failure(ctx, "http://a")
+			},
+			want: []string{"b"},
+		},
+		{name: "consistent hash without a key is round robin", strategy: balanceConsistentHash, want: []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBalancer(t, tt.strategy, time.Hour, "a", "b", "c")
+			if tt.setup != nil {
+				tt.setup(t, b)
+			}
+			tried := make(map[string]bool)
+			for _, n := range tt.tried {
+				tried["http://"+n] = true
+			}
+			var got []string
+			for range tt.want {
+				name := ""
+				if ep := b.pick(ctx, "", tried); ep != nil {
+					name = strings.TrimPrefix(ep.url, "http://")
+				}
+				got = append(got, name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("picked %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBalancerPickConsistentHash(t *testing.T) {
+	ctx := context.Background()
+	b := testBalancer(t, balanceConsistentHash, time.Hour, "a", "b", "c")
+	first := b.pick(ctx, "user-1", nil)
+	for i := 0; i < 5; i++ {
+		if ep := b.pick(ctx, "user-1", nil); ep != first {
+			t.Fatalf("pick %d of the same key went to %s, want %s", i, ep.url, first.url)
+		}
+	}
+	first.ejectedUntil = time.Now().Add(time.Minute)
+	moved := b.pick(ctx, "user-1", nil)
+	if moved == nil || moved == first {
+		t.Fatalf("key still picked the ejected endpoint %s", first.url)
+	}
+	first.ejectedUntil = time.Time{}
+	if ep := b.pick(ctx, "user-1", nil); ep != first {
+		t.Fatalf("key did not return to %s once it was back", first.url)
+	}
+}
+
+// A half-open circuit allows one trial call. pick must only ask the circuit of the endpoint it chooses,
+// or the trial of a circuit it passes over is used up without a call.
+func TestBalancerPickAsksOnlyTheChosenCircuit(t *testing.T) {
+	ctx := context.Background()
+	for _, strategy := range []string{balanceRoundRobin, balanceLeastOutstanding} {
+		t.Run(strategy, func(t *testing.T) {
+			// Cooldown 0: Allow moves an open circuit to half-open as soon as it is asked.
+			b := testBalancer(t, strategy, 0, "a", "b")
+			circuitBreaker.Failure(ctx, "http://b")
+			endpointNamed(t, b, "b").outstanding = 3
+			if ep := b.pick(ctx, "", nil); ep == nil || ep.url != "http://a" {
+				t.Fatalf("picked %v, want http://a", ep)
+			}
+			if got := circuitBreaker.States()["http://b"]; got != stateOpen {
+				t.Fatalf("circuit of the endpoint not picked is %s, want open", got)
+			}
+		})
+	}
+}
+
+func TestBalancerDoneEjection(t *testing.T) {
+	ctx := context.Background()
+	type call struct {
+		ep      string
+		outcome string // fail, ok or release
+	}
+	fails := func(ep string, n int) []call {
+		var out []call
+		for i := 0; i < n; i++ {
+			out = append(out, call{ep, "fail"})
+		}
+		return out
+	}
+	tests := []struct {
+		name       string
+		endpoints  []string
+		failures   int // PIPELINE_OUTLIER_CONSECUTIVE_FAILURES
+		maxPercent int // PIPELINE_OUTLIER_MAX_EJECTION_PERCENT
+		calls      []call
+		want       []string // ejected endpoints
+	}{
+		{name: "below the threshold", endpoints: []string{"a", "b"}, failures: 3, maxPercent: 50, calls: fails("a", 2)},
+		{name: "consecutive failures eject", endpoints: []string{"a", "b"}, failures: 3, maxPercent: 50, calls: fails("a", 3), want: []string{"a"}},
+		{
+			name: "success resets the count", endpoints: []string{"a", "b"}, failures: 3, maxPercent: 50,
+			calls: append(append(fails("a", 2), call{"a", "ok"}), fails("a", 2)...),
+		},
+		{
+			name: "release keeps the count", endpoints: []string{"a", "b"}, failures: 3, maxPercent: 50,
+			calls: append(append(fails("a", 2), call{"a", "release"}), fails("a", 1)...), want: []string{"a"},
+		},
+		{
+			name: "failures of other endpoints do not add up", endpoints: []string{"a", "b"}, failures: 2, maxPercent: 100,
+			calls: []call{{"a", "fail"}, {"b", "fail"}},
+		},
+		{
+			name: "max percent caps ejections", endpoints: []string{"a", "b", "c", "d"}, failures: 1, maxPercent: 50,
+			calls: append(append(fails("a", 1), fails("b", 1)...), fails("c", 3)...), want: []string{"a", "b"},
+		},
+		{name: "max percent below one endpoint", endpoints: []string{"a", "b", "c"}, failures: 1, maxPercent: 10, calls: fails("a", 3)},
+		{name: "ejection disabled", endpoints: []string{"a", "b"}, failures: 0, maxPercent: 100, calls: fails("a", 10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withOutlierConfig(t, tt.failures, tt.maxPercent)
+			b := testBalancer(t, balanceRoundRobin, time.Hour, tt.endpoints...)
+			for _, c := range tt.calls {
+				ep := endpointNamed(t, b, c.ep)
+				ep.outstanding++
+				switch c.outcome {
+				case "release":
+					b.release(ep)
+				default:
+					b.done(ctx, ep, c.outcome == "fail")
+				}
+			}
+			var got []string
+			now := time.Now()
+			for _, ep := range b.endpoints {
+				if now.Before(ep.ejectedUntil) {
+					got = append(got, strings.TrimPrefix(ep.url, "http://"))
+				}
+				if ep.outstanding != 0 {
+					t.Errorf("%s has %d outstanding after all calls finished", ep.url, ep.outstanding)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("ejected %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBalancerEjectionGrows(t *testing.T) {
+	ctx := context.Background()
+	withOutlierConfig(t, 1, 50)
+	b := testBalancer(t, balanceRoundRobin, time.Hour, "a", "b")
+	ep := endpointNamed(t, b, "a")
+	for n := 1; n <= 3; n++ {
+		ep.ejectedUntil = time.Time{} // the previous ejection ran out
+		ep.outstanding++
+		start := time.Now()
+		b.done(ctx, ep, true)
+		want := time.Duration(n) * clientConfig.OutlierEjection
+		if ep.ejections != n || ep.ejectedUntil.Before(start.Add(want)) || ep.ejectedUntil.After(time.Now().Add(want)) {
+			t.Fatalf("ejection %d: %d ejections until %v, want %d for %v", n, ep.ejections, ep.ejectedUntil.Sub(start), n, want)
+		}
+	}
+}
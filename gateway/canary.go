@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A service with variants sends part of its traffic to other versions of itself:
+//
+//	- name: transformer
+//	  url: http://transformer:8001
+//	  sticky_key: user_id
+//	  variants:
+//	    - name: v2
+//	      url: http://transformer-v2:8001
+//	      weight: 5
+//	    - name: beta
+//	      url: http://transformer-v2:8001
+//	      match: {headers: {X-Beta: "1"}}
+//
+// Weights are percentages of runs; the rest goes to url/endpoints (the "primary" variant). A variant whose
+// match rules all hold is used regardless of weight; one with rules that do not hold is never used. Runs
+// with the same sticky value (payload metadata sticky_key, else the request header of that name, else the
+// trace id) always get the same variant.
+
+// primaryVariant is the variant name of a service's own url/endpoints.
+const primaryVariant = "primary"
+
+// ServiceVariant is an alternative version of a service.
+type ServiceVariant struct {
+	Name   string        `json:"name" yaml:"name"`
+	URL    string        `json:"url" yaml:"url"`
+	Weight int           `json:"weight" yaml:"weight"`                   // percent of runs
+	Match  *VariantMatch `json:"match,omitempty" yaml:"match,omitempty"` // route matching runs here, ignoring weight
+}
+
+// VariantMatch selects runs by exact request header and payload metadata values; all of them must match.
+type VariantMatch struct {
+	Headers  map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+type runHeadersKey struct{}
+
+// withRunHeaders keeps the request headers of a run in ctx for variant match rules and sticky keys.
+func withRunHeaders(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, runHeadersKey{}, r.Header)
+}
+
+func runHeaders(ctx context.Context) http.Header {
+	h, _ := ctx.Value(runHeadersKey{}).(http.Header)
+	return h
+}
+
+func metadataString(payload map[string]interface{}, key string) (string, bool) {
+	meta, _ := payload["metadata"].(map[string]interface{})
+	v, ok := meta[key]
+	if !ok || v == nil {
+		return "", false
+	}
+	return fmt.Sprint(v), true
+}
+
+func (m *VariantMatch) matches(h http.Header, payload map[string]interface{}) bool {
+	for k, want := range m.Headers {
+		if h.Get(k) != want {
+			return false
+		}
+	}
+	for k, want := range m.Metadata {
+		if v, ok := metadataString(payload, k); !ok || v != want {
+			return false
+		}
+	}
+	return true
+}
+
+// stickyValue is what the variant of a run is hashed on.
+func stickyValue(ctx context.Context, s PipelineService, payload map[string]interface{}) string {
+	if s.StickyKey != "" {
+		if v, ok := metadataString(payload, s.StickyKey); ok && v != "" {
+			return v
+		}
+		if v := runHeaders(ctx).Get(s.StickyKey); v != "" {
+			return v
+		}
+	}
+	return trace.SpanContextFromContext(ctx).TraceID().String()
+}
+
+// pickVariant returns the service to call for this run: s itself, or s with the url of the variant picked,
+// and the variant name ("" when s has no variants).
+func pickVariant(ctx context.Context, s PipelineService, payload map[string]interface{}) (PipelineService, string) {
+	if len(s.Variants) == 0 {
+		return s, ""
+	}
+	h := runHeaders(ctx)
+	var matched, weighted []ServiceVariant
+	for _, v := range s.Variants {
+		if v.Match == nil {
+			weighted = append(weighted, v)
+		} else if v.Match.matches(h, payload) {
+			matched = append(matched, v)
+		}
+	}
+	pool := matched
+	if len(pool) == 0 {
+		pool = weighted
+		if s.URL != "" || len(s.Endpoints) > 0 {
+			rest := 100
+			for _, v := range weighted {
+				rest -= v.Weight
+			}
+			pool = append(pool[:len(pool):len(pool)], ServiceVariant{Name: primaryVariant, Weight: max(rest, 0)})
+		}
+	}
+	v, ok := weightedPick(pool, s.Name+"|"+stickyValue(ctx, s, payload))
+	if !ok || v.Name == primaryVariant {
+		return s, primaryVariant
+	}
+	return variantTarget(s, v), v.Name
+}
+
+// variantTarget is s with the url of variant v.
+func variantTarget(s PipelineService, v ServiceVariant) PipelineService {
+	out := s
+	out.URL = v.URL
+	out.Endpoints = nil
+	return out
+}
+
+// weightedPick picks from pool by weight, hashing key onto the total so the same key picks the same
+// variant. When every weight is 0 the first variant is picked.
+func weightedPick(pool []ServiceVariant, key string) (ServiceVariant, bool) {
+	if len(pool) == 0 {
+		return ServiceVariant{}, false
+	}
+	total := 0
+	for _, v := range pool {
+		total += max(v.Weight, 0)
+	}
+	if total == 0 {
+		return pool[0], true
+	}
+	n := int(hash32(key) % uint32(total))
+	for _, v := range pool {
+		if n < max(v.Weight, 0) {
+			return v, true
+		}
+		n -= max(v.Weight, 0)
+	}
+	return pool[len(pool)-1], true
+}
+
+// normalizeVariants trims the names and normalizes the URLs of variants.
+func normalizeVariants(vs []ServiceVariant) []ServiceVariant {
+	if vs == nil {
+		return nil
+	}
+	out := make([]ServiceVariant, len(vs))
+	for i, v := range vs {
+		v.Name = strings.TrimSpace(v.Name)
+		v.URL = NormalizeURL(v.URL)
+		out[i] = v
+	}
+	return out
+}
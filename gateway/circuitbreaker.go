@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -13,6 +14,16 @@ const (
 	stateHalfOpen
 )
 
+func (s circuitState) String() string {
+	switch s {
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
 type circuit struct {
 	state       circuitState
 	failures    int
@@ -28,6 +39,7 @@ type CircuitBreaker struct {
 	window      time.Duration
 	cooldown    time.Duration
 	nowFunc     func() time.Time
+	onChange    func(ctx context.Context, key string, from, to circuitState) // called with mu held; may be nil
 }
 
 // NewCircuitBreaker creates a circuit breaker with the given thresholds.
@@ -41,8 +53,9 @@ func NewCircuitBreaker(threshold int, window, cooldown time.Duration) *CircuitBr
 	}
 }
 
-// Allow returns true if a call is allowed (closed or half-open). If open, returns false.
-func (cb *CircuitBreaker) Allow(key string) bool {
+// Allow returns true if a call is allowed (closed or half-open). If open, returns false. ctx is the call's,
+// for logging the transition to half-open.
+func (cb *CircuitBreaker) Allow(ctx context.Context, key string) bool {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	now := cb.nowFunc()
@@ -55,7 +68,7 @@ func (cb *CircuitBreaker) Allow(key string) bool {
 		return true
 	case stateOpen:
 		if now.Sub(c.lastFailure) >= cb.cooldown {
-			c.state = stateHalfOpen
+			cb.setState(ctx, key, c, stateHalfOpen)
 			c.lastTry = now
 			return true
 		}
@@ -67,19 +80,19 @@ func (cb *CircuitBreaker) Allow(key string) bool {
 }
 
 // Success records a successful call and resets the circuit for that key.
-func (cb *CircuitBreaker) Success(key string) {
+func (cb *CircuitBreaker) Success(ctx context.Context, key string) {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	c, ok := cb.byKey[key]
 	if !ok {
 		return
 	}
-	c.state = stateClosed
+	cb.setState(ctx, key, c, stateClosed)
 	c.failures = 0
 }
 
 // Failure records a failed call. If failures reach threshold within window, opens the circuit.
-func (cb *CircuitBreaker) Failure(key string) {
+func (cb *CircuitBreaker) Failure(ctx context.Context, key string) {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	now := cb.nowFunc()
@@ -90,7 +103,7 @@ func (cb *CircuitBreaker) Failure(key string) {
 	}
 	c.lastTry = now
 	if c.state == stateHalfOpen {
-		c.state = stateOpen
+		cb.setState(ctx, key, c, stateOpen)
 		c.lastFailure = now
 		c.failures = cb.threshold
 		return
@@ -102,6 +115,30 @@ func (cb *CircuitBreaker) Failure(key string) {
 	c.failures++
 	c.lastFailure = now
 	if c.failures >= cb.threshold {
-		c.state = stateOpen
+		cb.setState(ctx, key, c, stateOpen)
+	}
+}
+
+// States returns the current state of every key that has recorded a failure.
+func (cb *CircuitBreaker) States() map[string]circuitState {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+	out := make(map[string]circuitState, len(cb.byKey))
+	for key, c := range cb.byKey {
+		out[key] = c.state
+	}
+	return out
+}
+
+// setState moves c to state and reports the transition to onChange with ctx, the context of the call that
+// caused it. Caller must hold cb.mu.
+func (cb *CircuitBreaker) setState(ctx context.Context, key string, c *circuit, state circuitState) {
+	if c.state == state {
+		return
+	}
+	from := c.state
+	c.state = state
+	if cb.onChange != nil {
+		cb.onChange(ctx, key, from, state)
 	}
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A service with compensate: <URL> can undo what it did. When a failed service stops a run (on_error
+// abort), the gateway POSTs to the compensate URL of each service that completed before it, newest first,
+// with the payload that service produced:
+//
+//	{"payload": {...}, "steps": [...], "compensation": {"service": "persister", "failed_service": "notifier", "error": "..."}}
+//
+// Any 2xx reply counts as done. Each call is a "compensate <name>" span and adds a step with status
+// "compensated" or "compensation_failed"; a failed compensation does not stop the others. Steps served by
+// a fallback are not compensated, and neither are dead-lettered runs, whose retry resumes after the
+// completed steps.
+
+// Compensation results, as reported in a step outcome's compensation.
+const (
+	compensationDone   = "compensated"
+	compensationFailed = "failed"
+)
+
+// completedStep is a service of a run that completed, with the payload it produced.
+type completedStep struct {
+	svc     PipelineService
+	outcome int // index in the run's outcomes
+	payload map[string]interface{}
+}
+
+// compensationTimeout bounds the whole compensation phase of a run (PIPELINE_COMPENSATION_TIMEOUT).
+func compensationTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PIPELINE_COMPENSATION_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 60 * time.Second
+}
+
+// compensate calls the compensate URLs of done, newest first, for the run res.failed stopped, and adds
+// the results to res.steps and res.outcomes. It does not stop when ctx is cancelled: a client that goes
+// away is a common reason for the run to abort, and that is when the undo matters most.
+func compensate(ctx context.Context, client *http.Client, done []completedStep, res *runResult) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), compensationTimeout())
+	defer cancel()
+	for i := len(done) - 1; i >= 0; i-- {
+		c := done[i]
+		err := callCompensate(ctx, client, c, res.steps, res.failed)
+		entry := map[string]interface{}{
+			"service":      c.svc.Name,
+			"status":       "compensated",
+			"compensation": true,
+			"input":        previewPayload(c.payload),
+			"output":       previewPayload(c.payload),
+		}
+		if len(c.svc.via) > 0 {
+			entry["pipeline"] = viaPath(c.svc.via)
+		}
+		res.outcomes[c.outcome].Compensation = compensationDone
+		if err != nil {
+			entry["status"], entry["error"] = "compensation_failed", err.Error()
+			res.outcomes[c.outcome].Compensation = compensationFailed
+		}
+		res.steps = append(res.steps[:len(res.steps):len(res.steps)], entry)
+	}
+}
+
+// compensateTarget is the service the compensate URL of svc is balanced as.
+func compensateTarget(svc PipelineService) PipelineService {
+	return PipelineService{Name: svc.Name + " (compensate)", URL: svc.Compensate}
+}
+
+// callCompensate posts the compensation request of c in a "compensate <name>" span.
+func callCompensate(ctx context.Context, client *http.Client, c completedStep, steps []interface{}, failed *stepOutcome) error {
+	ctx, span := otel.Tracer("gateway").Start(ctx, "compensate "+c.svc.Name, trace.WithAttributes(
+		attribute.String("compensate.service", c.svc.Name),
+		attribute.String("compensate.url", c.svc.Compensate),
+		attribute.String("compensate.failed_service", failed.Service),
+	))
+	defer span.End()
+	start := time.Now()
+	body, _ := json.Marshal(map[string]interface{}{
+		"payload": c.payload,
+		"steps":   steps,
+		"compensation": map[string]interface{}{
+			"service":        c.svc.Name,
+			"failed_service": failed.Service,
+			"error":          failed.Error,
+		},
+	})
+	lb := balancerFor(compensateTarget(c.svc))
+	resp, err := PostWithRetryAndCircuit(ctx, client, lb, "", "application/json", body, "", nil)
+	if err == nil {
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("%w: %s", &httpStatusError{status: resp.StatusCode}, b)
+		}
+	}
+	attrs := []interface{}{"service", c.svc.Name, "failed_service", failed.Service, "duration_ms", time.Since(start).Milliseconds()}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("compensate.result", compensationFailed))
+		logger.ErrorContext(ctx, "compensation failed", append(attrs, "error", err)...)
+		return err
+	}
+	span.SetAttributes(attribute.String("compensate.result", compensationDone))
+	logger.InfoContext(ctx, "step compensated", attrs...)
+	return nil
+}
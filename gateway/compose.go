@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+)
+
+// A pipeline entry with pipeline: runs another pipeline of the same config in its place; one with include:
+// runs the services of a YAML file (a services list, or a document with a services key). Both are expanded
+// when the config is loaded, so a run only ever sees plain services.
+
+// subPipelineRef is one sub-pipeline a service was expanded from: its name and the name of the entry that
+// referenced it. id distinguishes two references to the same pipeline so each gets its own span.
+type subPipelineRef struct {
+	Name  string
+	Entry string
+	id    int
+}
+
+// isComposite reports whether s references a pipeline or include file instead of calling a URL.
+func isComposite(s PipelineService) bool {
+	return s.Pipeline != "" || s.Include != ""
+}
+
+// compositeName is the name of a pipeline/include entry written without one.
+func compositeName(s PipelineService) string {
+	if s.Pipeline != "" {
+		return s.Pipeline
+	}
+	return strings.TrimSuffix(filepath.Base(s.Include), filepath.Ext(s.Include))
+}
+
+// defaultCompositeNames names unnamed pipeline/include entries after what they reference.
+func defaultCompositeNames(svc []PipelineService) {
+	for i := range svc {
+		if svc[i].Name == "" && isComposite(svc[i]) {
+			svc[i].Name = compositeName(svc[i])
+		}
+	}
+}
+
+// includeDir is the directory relative include: paths of the config are resolved against.
+func includeDir() string {
+	return filepath.Dir(getConfigPath())
+}
+
+// includePath resolves an include: path against dir, the directory of the including file. include: comes
+// from the API too, so only relative paths that stay inside includeDir() are allowed.
+func includePath(dir, include string) (string, error) {
+	if filepath.IsAbs(include) {
+		return "", errors.New("path must be relative")
+	}
+	root := filepath.Clean(includeDir())
+	path := filepath.Join(dir, include)
+	if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("path leaves the config directory")
+	}
+	return path, nil
+}
+
+// readInclude reads the services of an include file. Read and parse errors are logged but not returned:
+// they end up in API diagnostics, and YAML errors quote the file.
+func readInclude(path string) ([]PipelineService, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Warn("cannot read include file", "path", path, "error", err)
+		return nil, errors.New("cannot read file")
+	}
+	var def pipelineDef
+	if err := yaml.Unmarshal(data, &def); err != nil || def.Services == nil {
+		var list []PipelineService
+		if err2 := yaml.Unmarshal(data, &list); err2 != nil {
+			if err != nil {
+				logger.Warn("invalid include file", "path", path, "error", err)
+				return nil, errors.New("invalid YAML")
+			}
+			return nil, errors.New("no services defined")
+		}
+		def.Services = list
+	}
+	if len(def.Services) == 0 {
+		return nil, errors.New("no services defined")
+	}
+	defaultCompositeNames(def.Services)
+	return def.Services, nil
+}
+
+// expander flattens pipeline/include entries. stack holds the pipelines and files being expanded, to
+// report cycles.
+type expander struct {
+	ps    *pipelineSet
+	stack []string
+	next  int
+}
+
+func (e *expander) push(key string) error {
+	for i, k := range e.stack {
+		if k == key {
+			return fmt.Errorf("composition cycle: %s", strings.Join(append(e.stack[i:], key), " -> "))
+		}
+	}
+	e.stack = append(e.stack, key)
+	return nil
+}
+
+func (e *expander) pop() {
+	e.stack = e.stack[:len(e.stack)-1]
+}
+
+// expand resolves the ${...} references of svc and replaces pipeline/include entries by their services,
+// tagged with the sub-pipelines they came from (via).
+func (e *expander) expand(svc []PipelineService, dir string, via []subPipelineRef) ([]PipelineService, error) {
+	var out []PipelineService
+	for _, s := range svc {
+		r, err := resolveService(s)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", s.Name, err)
+		}
+		if !isComposite(r) {
+			r.via, r.referenced = via, len(referenceFields(s)) > 0
+			out = append(out, r)
+			continue
+		}
+		if r.Pipeline != "" && r.Include != "" {
+			return nil, fmt.Errorf("service %s: pipeline and include cannot both be set", s.Name)
+		}
+		var (
+			sub    []PipelineService
+			key    string
+			subDir = dir
+		)
+		if r.Pipeline != "" {
+			var ok bool
+			if sub, ok = e.ps.Pipelines[r.Pipeline]; !ok {
+				return nil, fmt.Errorf("service %s: unknown pipeline %q", s.Name, r.Pipeline)
+			}
+			key = r.Pipeline
+		} else {
+			path, err := includePath(dir, r.Include)
+			if err == nil {
+				sub, err = readInclude(path)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("service %s: include %s: %w", s.Name, r.Include, err)
+			}
+			key = path
+			subDir = filepath.Dir(path)
+		}
+		if err := e.push(key); err != nil {
+			return nil, err
+		}
+		e.next++
+		ref := subPipelineRef{Name: compositeName(r), Entry: s.Name, id: e.next}
+		expanded, err := e.expand(sub, subDir, append(via[:len(via):len(via)], ref))
+		if err != nil {
+			return nil, err
+		}
+		e.pop()
+		out = append(out, expanded...)
+	}
+	return out, nil
+}
+
+// viaPath is the sub-pipeline path of an expanded service, outermost first ("" for top-level services).
+func viaPath(via []subPipelineRef) string {
+	names := make([]string, len(via))
+	for i, ref := range via {
+		names[i] = ref.Name
+	}
+	return strings.Join(names, "/")
+}
+
+// tagStep adds the sub-pipeline path of s to the step a service appended to steps.
+func tagStep(steps []interface{}, s PipelineService) map[string]interface{} {
+	last := map[string]interface{}{}
+	if len(steps) > 0 {
+		if m, ok := steps[len(steps)-1].(map[string]interface{}); ok {
+			last = m
+		}
+	}
+	if len(s.via) > 0 && len(steps) > 0 {
+		last["pipeline"] = viaPath(s.via)
+	}
+	return last
+}
+
+// subPipelineSpans keeps one span open per sub-pipeline the current step was expanded from, so a trace
+// shows the steps of a sub-pipeline under a "pipeline <name>" span.
+type subPipelineSpans struct {
+	root context.Context
+	open []openSubPipeline
+}
+
+type openSubPipeline struct {
+	ref  subPipelineRef
+	ctx  context.Context
+	span trace.Span
+}
+
+func newSubPipelineSpans(ctx context.Context) *subPipelineSpans {
+	return &subPipelineSpans{root: ctx}
+}
+
+// enter ends the spans of sub-pipelines s is not part of, starts the ones it enters and returns the
+// context to call s with.
+func (c *subPipelineSpans) enter(s PipelineService) context.Context {
+	n := 0
+	for n < len(c.open) && n < len(s.via) && c.open[n].ref == s.via[n] {
+		n++
+	}
+	c.closeFrom(n)
+	ctx := c.root
+	if n > 0 {
+		ctx = c.open[n-1].ctx
+	}
+	for _, ref := range s.via[n:] {
+		var span trace.Span
+		ctx, span = otel.Tracer("gateway").Start(ctx, "pipeline "+ref.Name, trace.WithAttributes(
+			attribute.String("pipeline.name", ref.Name),
+			attribute.String("pipeline.path", viaPath(s.via[:len(c.open)+1])),
+		))
+		c.open = append(c.open, openSubPipeline{ref: ref, ctx: ctx, span: span})
+	}
+	return ctx
+}
+
+func (c *subPipelineSpans) closeFrom(n int) {
+	for i := len(c.open) - 1; i >= n; i-- {
+		c.open[i].span.End()
+	}
+	c.open = c.open[:n]
+}
+
+// end ends every open span.
+func (c *subPipelineSpans) end() {
+	c.closeFrom(0)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// configDir points PIPELINE_CONFIG_PATH into a fresh directory, the root include: paths are confined to,
+// and writes files (relative path -> content) into it.
+func configDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("PIPELINE_CONFIG_PATH", filepath.Join(dir, "pipeline.yaml"))
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestIncludePath(t *testing.T) {
+	root := configDir(t, nil)
+	tests := []struct {
+		name    string
+		dir     string // relative to root
+		include string
+		want    string // relative to root; "" = rejected
+	}{
+		{"sibling", ".", "steps.yaml", "steps.yaml"},
+		{"subdirectory", ".", "shared/steps.yaml", "shared/steps.yaml"},
+		{"relative to the including file", "shared", "more.yaml", "shared/more.yaml"},
+		{"up but still inside", "shared", "../steps.yaml", "steps.yaml"},
+		{"dot segments", ".", "./shared/../steps.yaml", "steps.yaml"},
+		{"absolute", ".", "/etc/passwd", ""},
+		{"leaves the root", ".", "../steps.yaml", ""},
+		{"leaves the root from a subdirectory", "shared", "../../steps.yaml", ""},
+		{"prefix of the root is not inside it", ".", "../" + filepath.Base(root) + "x/steps.yaml", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := includePath(filepath.Join(root, tt.dir), tt.include)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("includePath(%q, %q) = %q, want an error", tt.dir, tt.include, got)
+				}
+				return
+			}
+			if want := filepath.Join(root, tt.want); err != nil || got != want {
+				t.Fatalf("includePath(%q, %q) = %q, %v; want %q", tt.dir, tt.include, got, err, want)
+			}
+		})
+	}
+}
+
+func TestPipelineSetResolveComposition(t *testing.T) {
+	svc := func(name string) PipelineService { return PipelineService{Name: name, URL: "http://" + name} }
+	sub := func(pipeline string) PipelineService { return PipelineService{Name: pipeline, Pipeline: pipeline} }
+	inc := func(name, path string) PipelineService { return PipelineService{Name: name, Include: path} }
+	tests := []struct {
+		name      string
+		files     map[string]string
+		pipelines map[string][]PipelineService
+		want      []string // services of main as name@via path
+		wantErr   string
+	}{
+		{
+			name:      "nested pipelines",
+			pipelines: map[string][]PipelineService{"main": {svc("a"), sub("inner"), svc("d")}, "inner": {svc("b"), sub("leaf")}, "leaf": {svc("c")}},
+			want:      []string{"a@", "b@inner", "c@inner/leaf", "d@"},
+		},
+		{
+			name:      "same pipeline twice is not a cycle",
+			pipelines: map[string][]PipelineService{"main": {sub("leaf"), sub("leaf")}, "leaf": {svc("c")}},
+			want:      []string{"c@leaf", "c@leaf"},
+		},
+		{
+			name:      "include relative to the including file",
+			files:     map[string]string{"shared/outer.yaml": "- include: inner.yaml\n", "shared/inner.yaml": "services:\n  - name: b\n    url: http://b\n"},
+			pipelines: map[string][]PipelineService{"main": {svc("a"), inc("outer", "shared/outer.yaml")}},
+			want:      []string{"a@", "b@outer/inner"},
+		},
+		{
+			name:      "pipeline cycle",
+			pipelines: map[string][]PipelineService{"main": {sub("other")}, "other": {svc("a"), sub("main")}},
+			wantErr:   "composition cycle: main -> other -> main",
+		},
+		{
+			name:      "self reference",
+			pipelines: map[string][]PipelineService{"main": {svc("a"), sub("main")}},
+			wantErr:   "composition cycle: main -> main",
+		},
+		{
+			name:      "include cycle",
+			files:     map[string]string{"loop.yaml": "- include: shared/back.yaml\n", "shared/back.yaml": "- include: ../loop.yaml\n"},
+			pipelines: map[string][]PipelineService{"main": {inc("loop", "loop.yaml")}},
+			wantErr:   "composition cycle",
+		},
+		{
+			name:      "include leaving the config directory",
+			pipelines: map[string][]PipelineService{"main": {inc("outside", "../outside.yaml")}},
+			wantErr:   "path leaves the config directory",
+		},
+		{
+			name:      "nested include leaving the config directory",
+			files:     map[string]string{"shared/escape.yaml": "- include: ../../outside.yaml\n"},
+			pipelines: map[string][]PipelineService{"main": {inc("escape", "shared/escape.yaml")}},
+			wantErr:   "path leaves the config directory",
+		},
+		{
+			name:      "absolute include",
+			pipelines: map[string][]PipelineService{"main": {inc("abs", "/etc/passwd")}},
+			wantErr:   "path must be relative",
+		},
+		{
+			name:      "unknown pipeline",
+			pipelines: map[string][]PipelineService{"main": {sub("missing")}},
+			wantErr:   `unknown pipeline "missing"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configDir(t, tt.files)
+			ps := &pipelineSet{Default: "main", Pipelines: tt.pipelines}
+			err := ps.resolve()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolve: got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve: %v", err)
+			}
+			var got []string
+			for _, s := range ps.resolved["main"] {
+				got = append(got, s.Name+"@"+viaPath(s.via))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("main resolved to %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
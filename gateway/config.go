@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -12,30 +19,67 @@ import (
 
 // PipelineService is one microservice in the pipeline.
 type PipelineService struct {
-	Name        string `json:"name" yaml:"name"`
-	URL         string `json:"url" yaml:"url"`
-	Icon        string `json:"icon" yaml:"icon"`
-	Description string `json:"description" yaml:"description"`
-	InputType   string `json:"input_type" yaml:"input_type"`
-	OutputType  string `json:"output_type" yaml:"output_type"`
+	Name        string           `json:"name" yaml:"name"`
+	URL         string           `json:"url" yaml:"url"`
+	Icon        string           `json:"icon" yaml:"icon"`
+	Description string           `json:"description" yaml:"description"`
+	InputType   string           `json:"input_type" yaml:"input_type"`
+	OutputType  string           `json:"output_type" yaml:"output_type"`
+	Pipeline    string           `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`     // run this pipeline here instead of a URL
+	Include     string           `json:"include,omitempty" yaml:"include,omitempty"`       // run the services of this YAML file here
+	Endpoints   []string         `json:"endpoints,omitempty" yaml:"endpoints,omitempty"`   // more base URLs, load balanced with url
+	Balance     string           `json:"balance,omitempty" yaml:"balance,omitempty"`       // round_robin (default), least_outstanding, consistent_hash
+	HashKey     string           `json:"hash_key,omitempty" yaml:"hash_key,omitempty"`     // payload metadata key for consistent_hash
+	Variants    []ServiceVariant `json:"variants,omitempty" yaml:"variants,omitempty"`     // canary versions (see canary.go)
+	StickyKey   string           `json:"sticky_key,omitempty" yaml:"sticky_key,omitempty"` // metadata key/header a run's variant is hashed on
+	Shadow      string           `json:"shadow,omitempty" yaml:"shadow,omitempty"`         // also send each request here, compare, discard (see shadow.go)
+	Hedge       *HedgePolicy     `json:"hedge,omitempty" yaml:"hedge,omitempty"`           // send a second request when the first is slow (see hedge.go)
+	Fallback    *ServiceFallback `json:"fallback,omitempty" yaml:"fallback,omitempty"`     // used when the service fails (see fallback.go)
+	OnError     string           `json:"on_error,omitempty" yaml:"on_error,omitempty"`     // abort (default), skip, continue, dead_letter (see run.go)
+	Compensate  string           `json:"compensate,omitempty" yaml:"compensate,omitempty"` // undo endpoint called when a later step aborts the run (see compensate.go)
+
+	via        []subPipelineRef // sub-pipelines this service was expanded from (resolved services only)
+	referenced bool             // the definition had ${...} references (resolved services only)
 }
 
 type pipelineConfig struct {
-	Services []PipelineService `yaml:"services"`
+	Version         int                    `json:"version,omitempty" yaml:"version,omitempty"`
+	DefaultPipeline string                 `json:"default_pipeline,omitempty" yaml:"default_pipeline,omitempty"`
+	Services        []PipelineService      `json:"services,omitempty" yaml:"services,omitempty"`
+	Pipelines       map[string]pipelineDef `json:"pipelines,omitempty" yaml:"pipelines,omitempty"`
+}
+
+type pipelineDef struct {
+	Services []PipelineService `json:"services" yaml:"services"`
+}
+
+// pipelineSet is every named pipeline plus the name of the one served by the unnamed endpoints.
+// Version is the config version (see versions.go); files without one are version 1.
+// Only the resolved services are used to call services; APIs and the file always see Pipelines.
+type pipelineSet struct {
+	Version   int
+	Default   string
+	Pipelines map[string][]PipelineService // as written, with ${...} references
+	resolved  map[string][]PipelineService // references resolved (see interpolate.go); nil until resolve()
+	rev       string                       // config store revision this set was read from
 }
 
 var (
-	configMu        sync.RWMutex
-	configMemory    []PipelineService   // nil = not set, load from file (used when not file-authoritative)
-	fileCache       []PipelineService   // used when file-authoritative
-	fileCacheMtime  time.Time            // mtime of file when fileCache was loaded
-	fileCachePath   string               // path we cached from
+	errPipelineNotFound   = errors.New("pipeline not found")
+	errDeleteDefault      = errors.New("cannot delete the default pipeline")
+	errPreconditionFailed = errors.New("pipeline config was changed by someone else; reload and try again")
+	errInvalidPipeline    = errors.New("invalid pipeline config")
 )
 
-// fileAuthoritative returns true when pipeline config should always be read from file (shared across replicas).
-func fileAuthoritative() bool {
-	return getWritablePath() != ""
-}
+var (
+	configMu        sync.RWMutex
+	configWriteMu   sync.Mutex            // serializes read-modify-write of the pipeline set
+	configMemory    *pipelineSet          // nil = not set, load from file (used without a config store)
+	storeCache      *pipelineSet          // last config read from configStore (see store.go)
+	storeSeenRev    string               // store revision last read, even if it failed to parse
+	storeStale      bool                 // storeCache must be re-read (store watch fired, or about to write)
+	configSource    ConfigSource         // where the active config came from (see source.go)
+)
 
 func getConfigPath() string {
 	if p := os.Getenv("PIPELINE_CONFIG_PATH"); p != "" {
@@ -48,6 +92,18 @@ func getWritablePath() string {
 	return os.Getenv("WRITABLE_PIPELINE_PATH")
 }
 
+// defaultPipelineName is the pipeline behind /process, /api/pipeline etc.: DEFAULT_PIPELINE, else the file's
+// default_pipeline, else "default".
+func defaultPipelineName(fromFile string) string {
+	if v := strings.TrimSpace(os.Getenv("DEFAULT_PIPELINE")); v != "" {
+		return v
+	}
+	if fromFile != "" {
+		return fromFile
+	}
+	return "default"
+}
+
 func defaultPipeline() []PipelineService {
 	env := func(key, def string) string {
 		if v := os.Getenv(key); v != "" {
@@ -63,85 +119,168 @@ func defaultPipeline() []PipelineService {
 	}
 }
 
-func loadPipelineFromFile() []PipelineService {
-	paths := []string{
-		getConfigPath(),
-		"/app/pipeline.example.yaml",
+// toSet converts a parsed file into a pipeline set. The top-level services list is the default pipeline
+// unless pipelines defines one with that name. Returns nil when the file defines no services.
+func (cfg *pipelineConfig) toSet() *pipelineSet {
+	ps := &pipelineSet{
+		Version:   cfg.Version,
+		Default:   defaultPipelineName(cfg.DefaultPipeline),
+		Pipelines: make(map[string][]PipelineService),
 	}
-	if wd, err := os.Getwd(); err == nil {
-		paths = append(paths, filepath.Join(wd, "..", "pipeline.example.yaml"))
+	if ps.Version <= 0 {
+		ps.Version = 1
 	}
-	for _, path := range paths {
-		data, err := os.ReadFile(path)
-		if err != nil {
-			continue
-		}
-		var cfg pipelineConfig
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			continue
+	for name, def := range cfg.Pipelines {
+		if len(def.Services) > 0 {
+			defaultCompositeNames(def.Services)
+			ps.Pipelines[name] = def.Services
 		}
-		if len(cfg.Services) > 0 {
-			return cfg.Services
+	}
+	if _, ok := ps.Pipelines[ps.Default]; !ok && len(cfg.Services) > 0 {
+		defaultCompositeNames(cfg.Services)
+		ps.Pipelines[ps.Default] = cfg.Services
+	}
+	if len(ps.Pipelines) == 0 {
+		return nil
+	}
+	return ps
+}
+
+// toConfig converts a pipeline set back to the file format. A lone pipeline named "default" is written
+// as the legacy top-level services list.
+func (ps *pipelineSet) toConfig() pipelineConfig {
+	if len(ps.Pipelines) == 1 && ps.Default == "default" {
+		if svc, ok := ps.Pipelines[ps.Default]; ok {
+			return pipelineConfig{Version: ps.Version, Services: svc}
 		}
 	}
-	return defaultPipeline()
+	cfg := pipelineConfig{
+		Version:         ps.Version,
+		DefaultPipeline: ps.Default,
+		Pipelines:       make(map[string]pipelineDef, len(ps.Pipelines)),
+	}
+	for name, svc := range ps.Pipelines {
+		cfg.Pipelines[name] = pipelineDef{Services: svc}
+	}
+	return cfg
 }
 
-// loadPipelineFromPath reads pipeline from a specific path. Returns nil if read fails or no services.
-func loadPipelineFromPath(path string) []PipelineService {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil
+func (ps *pipelineSet) clone() *pipelineSet {
+	out := &pipelineSet{Version: ps.Version, Default: ps.Default, Pipelines: make(map[string][]PipelineService, len(ps.Pipelines))}
+	for name, svc := range ps.Pipelines {
+		cp := make([]PipelineService, len(svc))
+		copy(cp, svc)
+		out.Pipelines[name] = cp
 	}
-	var cfg pipelineConfig
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil
+	out.resolved = ps.resolved
+	out.rev = ps.rev
+	return out
+}
+
+// names returns pipeline names sorted alphabetically.
+func (ps *pipelineSet) names() []string {
+	out := make([]string, 0, len(ps.Pipelines))
+	for name := range ps.Pipelines {
+		out = append(out, name)
 	}
-	if len(cfg.Services) == 0 {
-		return nil
+	sort.Strings(out)
+	return out
+}
+
+// loadPipelineFromFile loads the first usable file of PIPELINE_CONFIG_PATH and the example configs, else the
+// built-in defaults, and records where the config came from in configSource. Caller must hold configMu.
+func loadPipelineFromFile() *pipelineSet {
+	candidates := [][2]string{
+		{getConfigPath(), "configured"},
+		{"/app/pipeline.example.yaml", "example"},
+	}
+	if wd, err := os.Getwd(); err == nil {
+		candidates = append(candidates, [2]string{filepath.Join(wd, "..", "pipeline.example.yaml"), "example"})
 	}
-	return cfg.Services
+	var errs []sourceError
+	for _, c := range candidates {
+		ps, src, err := readPipelineSource(c[0], c[1])
+		if err != nil {
+			errs = append(errs, sourceError{Path: c[0], Error: err.Error()})
+			continue
+		}
+		src.Fallback = c[1] != "configured"
+		src.Errors = errs
+		configSource = src
+		return ps
+	}
+	configSource = ConfigSource{Kind: "defaults", LoadedAt: time.Now().UTC(), Fallback: true, Errors: errs}
+	name := defaultPipelineName("")
+	ps := &pipelineSet{Version: 1, Default: name, Pipelines: map[string][]PipelineService{name: defaultPipeline()}}
+	_ = ps.resolve()
+	return ps
 }
 
-// LoadPipeline returns the current pipeline (file-authoritative or memory/file).
-func LoadPipeline() []PipelineService {
-	if fileAuthoritative() {
-		path := getWritablePath()
-		if path == "" {
-			path = getConfigPath()
+// readPipelineFile reads pipelines from a specific path, returning why it failed (missing, YAML error, no services).
+func readPipelineFile(path string) (*pipelineSet, error) {
+	ps, _, err := readPipelineSource(path, "")
+	return ps, err
+}
+
+// validatePipelineSet runs the offline checks of validatePipeline on every pipeline and returns the first error.
+func validatePipelineSet(ps *pipelineSet) error {
+	for _, name := range ps.names() {
+		if diags := validatePipeline(context.Background(), ps.Pipelines[name], validateOptions{}); hasErrors(diags) {
+			return fmt.Errorf("pipeline %s: %s", name, firstError(diags))
 		}
+	}
+	return nil
+}
+
+// loadPipelineSet returns a copy of all pipelines (config store, or memory/file).
+func loadPipelineSet() *pipelineSet {
+	if configStore != nil {
 		configMu.Lock()
 		defer configMu.Unlock()
-		info, err := os.Stat(path)
-		if err == nil && !info.ModTime().After(fileCacheMtime) && fileCachePath == path && len(fileCache) > 0 {
-			out := make([]PipelineService, len(fileCache))
-			copy(out, fileCache)
-			return out
-		}
-		svc := loadPipelineFromPath(path)
-		if svc != nil {
-			fileCache = svc
-			fileCachePath = path
-			if info != nil {
-				fileCacheMtime = info.ModTime()
+		if storeCache != nil && !storeStale {
+			if rc, ok := configStore.(revisionChecker); !ok || rc.Current(storeSeenRev) {
+				return storeCache.clone()
 			}
-			out := make([]PipelineService, len(svc))
-			copy(out, svc)
-			return out
-		}
-		// Fallback to read-only paths
-		fileCache = nil
-		fileCachePath = ""
-		svc = loadPipelineFromFile()
-		out := make([]PipelineService, len(svc))
-		copy(out, svc)
-		return out
+		}
+		ps, src, rev, err := readStoreSource(configStore)
+		storeStale = false
+		storeSeenRev = rev
+		// Once a config has loaded, a broken or invalid write keeps the last good one until it is fixed.
+		if storeCache != nil {
+			if errors.Is(err, errConfigNotStored) && storeCache.rev == "" {
+				return storeCache.clone() // still seeded from the read-only files
+			}
+			if err == nil {
+				err = validatePipelineSet(ps)
+			}
+			if err != nil {
+				if msg := err.Error(); msg != configSource.ReloadError {
+					configSource.ReloadError = msg
+					logger.Error("pipeline config reload failed; keeping last good config", "store", configStore.Kind(), "location", configStore.Location(), "error", err)
+				}
+				return storeCache.clone()
+			}
+		}
+		if err == nil {
+			ps.rev = rev
+			if storeCache != nil {
+				pruneBalancers(ps)
+			}
+			storeCache = ps
+			configSource = src
+			return ps.clone()
+		}
+		// Nothing usable stored yet: start from the read-only files; the first write stores it.
+		out := loadPipelineFromFile()
+		out.rev = rev
+		configSource.Errors = append([]sourceError{{Path: configStore.Location(), Error: err.Error()}}, configSource.Errors...)
+		storeCache = out
+		return out.clone()
 	}
 
 	configMu.RLock()
 	if configMemory != nil {
-		out := make([]PipelineService, len(configMemory))
-		copy(out, configMemory)
+		out := configMemory.clone()
 		configMu.RUnlock()
 		return out
 	}
@@ -152,45 +291,253 @@ func LoadPipeline() []PipelineService {
 	if configMemory == nil {
 		configMemory = loadPipelineFromFile()
 	}
-	out := make([]PipelineService, len(configMemory))
-	copy(out, configMemory)
-	return out
+	return configMemory.clone()
 }
 
-// SetPipeline sets the in-memory pipeline and optionally writes to WRITABLE_PIPELINE_PATH.
-// When file-authoritative (WRITABLE_PIPELINE_PATH set), writes to file and invalidates cache so next LoadPipeline reads from file.
-func SetPipeline(services []PipelineService) error {
-	path := getWritablePath()
-	if path != "" {
-		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-			return err
+// LoadPipeline returns the current default pipeline (config store, or memory/file).
+func LoadPipeline() []PipelineService {
+	rp, _ := ResolvePipeline("")
+	return rp.Services
+}
+
+// resolvedPipeline is one pipeline plus the config version it was read from.
+type resolvedPipeline struct {
+	Name     string
+	Version  int
+	Services []PipelineService
+}
+
+// ResolvePipeline returns the pipeline called name, or the default pipeline when name is empty, with
+// ${...} references resolved. Do not return its services from APIs; they may contain secrets.
+// The returned Name is the resolved pipeline name; ok is false if no such pipeline exists.
+func ResolvePipeline(name string) (resolvedPipeline, bool) {
+	ps := loadPipelineSet()
+	if name == "" {
+		name = ps.Default
+	}
+	svc, ok := ps.Pipelines[name]
+	if r, found := ps.resolved[name]; found {
+		svc = r
+	}
+	return resolvedPipeline{Name: name, Version: ps.Version, Services: svc}, ok
+}
+
+// PipelineNames returns all pipeline names (sorted) and the default pipeline name.
+func PipelineNames() ([]string, string) {
+	ps := loadPipelineSet()
+	return ps.names(), ps.Default
+}
+
+// ChangeMeta identifies who is changing the config and which config they based the change on.
+type ChangeMeta struct {
+	Author       string
+	SelfAsserted bool   // Author comes from the unverified X-Author header
+	IfMatch      string // If-Match header value; "" or "*" skips the check
+}
+
+// commitResult is the config version and ETag after a successful change.
+type commitResult struct {
+	Version int
+	ETag    string
+}
+
+// SetPipeline replaces the default pipeline. See SetNamedPipeline.
+func SetPipeline(services []PipelineService, meta ChangeMeta) (commitResult, error) {
+	return SetNamedPipeline("", services, meta)
+}
+
+// SetNamedPipeline creates or replaces the pipeline called name ("" = default) and optionally writes all
+// pipelines to WRITABLE_PIPELINE_PATH. The change is recorded as a new version by meta.Author.
+// Returns errPreconditionFailed when meta.IfMatch does not match the current config.
+func SetNamedPipeline(name string, services []PipelineService, meta ChangeMeta) (commitResult, error) {
+	return UpdateNamedPipeline(name, meta, func([]PipelineService) ([]PipelineService, error) {
+		return services, nil
+	})
+}
+
+// UpdateNamedPipeline atomically replaces the pipeline called name ("" = default) with fn applied to its
+// current services (nil if it does not exist yet). If fn returns an error nothing is written.
+func UpdateNamedPipeline(name string, meta ChangeMeta, fn func([]PipelineService) ([]PipelineService, error)) (commitResult, error) {
+	var res commitResult
+	var count int
+	err := withConfigLock(func() error {
+		old := loadPipelineSet()
+		if !etagMatches(meta.IfMatch, pipelineETag(old)) {
+			return errPreconditionFailed
+		}
+		if name == "" {
+			name = old.Default
 		}
-		cfg := pipelineConfig{Services: services}
-		data, err := yaml.Marshal(&cfg)
+		ps := old.clone()
+		services, err := fn(ps.Pipelines[name])
 		if err != nil {
 			return err
 		}
-		if err := os.WriteFile(path, data, 0644); err != nil {
+		if err := checkNoNewReferences(services, ps.Pipelines[name]); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidPipeline, err)
+		}
+		ps.Pipelines[name] = services
+		count = len(services)
+		res, err = commitPipelineSet(old, ps, versionChange{Action: "update", Pipeline: name, Author: meta.Author, SelfAsserted: meta.SelfAsserted})
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	logger.Info("pipeline config updated", "pipeline", name, "services", count, "version", res.Version, "author", meta.Author, "store", storeLocation())
+	return res, nil
+}
+
+// DeletePipeline removes the pipeline called name. The default pipeline cannot be deleted.
+func DeletePipeline(name string, meta ChangeMeta) (commitResult, error) {
+	var res commitResult
+	err := withConfigLock(func() error {
+		old := loadPipelineSet()
+		if !etagMatches(meta.IfMatch, pipelineETag(old)) {
+			return errPreconditionFailed
+		}
+		if _, ok := old.Pipelines[name]; !ok {
+			return errPipelineNotFound
+		}
+		if name == old.Default {
+			return errDeleteDefault
+		}
+		ps := old.clone()
+		delete(ps.Pipelines, name)
+		var err error
+		res, err = commitPipelineSet(old, ps, versionChange{Action: "delete", Pipeline: name, Author: meta.Author, SelfAsserted: meta.SelfAsserted})
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	logger.Info("pipeline deleted", "pipeline", name, "version", res.Version, "author", meta.Author, "store", storeLocation())
+	return res, nil
+}
+
+// withConfigLock runs fn with exclusive access to the pipeline config: a process-wide mutex and, for
+// stores that need one, a lock shared with other replicas (other stores reject conflicting writes instead).
+// The store cache is marked stale first so fn sees what other replicas wrote.
+func withConfigLock(fn func() error) error {
+	configWriteMu.Lock()
+	defer configWriteMu.Unlock()
+	if l, ok := configStore.(storeLocker); ok {
+		unlock, err := l.Lock()
+		if err != nil {
 			return err
 		}
+		defer unlock()
+	}
+	if configStore != nil {
 		configMu.Lock()
-		fileCache = nil
-		fileCachePath = ""
+		storeStale = true
 		configMu.Unlock()
-		return nil
 	}
+	return fn()
+}
 
+// savePipelineSet writes ps to the config store, or keeps it in memory when there is none, and makes it
+// the active config. The write is a compare-and-swap on ps.rev; if another replica wrote first it fails
+// with errPreconditionFailed. Caller must hold the config lock (see withConfigLock).
+func savePipelineSet(ps *pipelineSet) error {
+	if err := ps.resolve(); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidPipeline, err)
+	}
+	cfg := ps.toConfig()
+	data, err := yaml.Marshal(&cfg)
+	if err != nil {
+		return err
+	}
+	if configStore == nil {
+		configMu.Lock()
+		configMemory = ps
+		configSource = dataSource("api", "", data)
+		configMu.Unlock()
+		pruneBalancers(ps)
+		return nil
+	}
+	rev, err := configStore.Put(context.Background(), data, ps.rev)
+	if errors.Is(err, errStoreConflict) {
+		return errPreconditionFailed
+	}
+	if err != nil {
+		return err
+	}
+	src := dataSource(configStore.Kind(), configStore.Location(), data)
+	now := time.Now().UTC()
+	src.ModTime = &now
 	configMu.Lock()
-	configMemory = services
+	ps.rev = rev
+	storeCache = ps.clone()
+	storeSeenRev = rev
+	storeStale = rev == "" // revision unknown: re-read before the next use
+	configSource = src
 	configMu.Unlock()
+	pruneBalancers(ps)
 	return nil
 }
 
+// writeFileAtomic writes data to a temp file next to path and renames it over path, so readers never
+// see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// pipelineETag is a strong ETag over the whole config (all pipelines), combining version and content hash.
+func pipelineETag(ps *pipelineSet) string {
+	cfg := ps.toConfig()
+	raw, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(raw)
+	return fmt.Sprintf("\"%d-%s\"", ps.Version, hex.EncodeToString(sum[:8]))
+}
+
+// etagMatches reports whether an If-Match header value matches etag. Empty and "*" always match.
+func etagMatches(ifMatch, etag string) bool {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
 // NormalizeURL ensures URL has a scheme.
 func NormalizeURL(url string) string {
 	url = strings.TrimSpace(url)
-	if url == "" {
-		return url
+	if url == "" || strings.HasPrefix(url, "${") || isDiscoveryURL(url) {
+		return url // references get a scheme once resolved; discovery URLs have their own
 	}
 	if !strings.Contains(url, "://") {
 		return "http://" + url
@@ -198,12 +545,13 @@ func NormalizeURL(url string) string {
 	return url
 }
 
-// PipelineNamesURLs returns (name, url) pairs for the current pipeline.
-func PipelineNamesURLs() [][2]string {
-	svc := LoadPipeline()
-	out := make([][2]string, len(svc))
-	for i := range svc {
-		out[i] = [2]string{svc[i].Name, svc[i].URL}
+// normalizeURLs normalizes each URL and drops empty ones (nil if none are left).
+func normalizeURLs(urls []string) []string {
+	var out []string
+	for _, u := range urls {
+		if u = NormalizeURL(u); u != "" {
+			out = append(out, u)
+		}
 	}
 	return out
 }
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A run stopped by a service with on_error: dead_letter is kept as a dead letter: the run's input, the payload
+// and steps the failed service was given, the service and its error. POST /api/deadletters/{id}/retry resumes
+// the run at that service with the current config, keeping the outcomes of the steps before it and
+// compensating them too if the resumed run is aborted; DELETE discards it. Dead letters are JSON lines in
+// DEAD_LETTER_PATH, which replicas may share (writes take a file lock), and are dropped after
+// DEAD_LETTER_MAX_AGE.
+
+var (
+	errDeadLetterNotFound = errors.New("dead letter not found")
+	errDeadLetterRetrying = errors.New("dead letter is already being retried")
+)
+
+// deadLetterRetryClaim is how long a retry holds its claim on a dead letter if the gateway running it dies
+// before releasing it.
+const deadLetterRetryClaim = 30 * time.Minute
+
+// DeadLetter is one stored run.
+type DeadLetter struct {
+	ID              string                 `json:"id"`
+	Time            time.Time              `json:"time"`
+	Pipeline        string                 `json:"pipeline"`
+	PipelineVersion int                    `json:"pipeline_version"`
+	TraceID         string                 `json:"trace_id"` // of the last failed attempt
+	Service         string                 `json:"service"`  // the service that failed
+	SubPipeline     string                 `json:"sub_pipeline,omitempty"`
+	Step            int                    `json:"step"` // index of the service in the pipeline's expanded services
+	Error           string                 `json:"error"`
+	Input           map[string]interface{} `json:"input"`   // the run's input payload
+	Payload         map[string]interface{} `json:"payload"` // what the failed service was sent
+	Steps           []interface{}          `json:"steps"`   // steps before the failed service
+	Outcomes        []stepOutcome          `json:"outcomes"`
+	Completed       []deadLetterStep       `json:"completed,omitempty"` // steps before the failed service to compensate
+	Retries         int                    `json:"retries"`
+	LastRetry       *time.Time             `json:"last_retry,omitempty"`
+	RetryingUntil   *time.Time             `json:"retrying_until,omitempty"` // claimed by a retry in progress
+}
+
+// deadLetterStep is a completed step of a dead-lettered run that has a compensate URL, with the payload it
+// produced and the index of its outcome.
+type deadLetterStep struct {
+	Service     string                 `json:"service"`
+	SubPipeline string                 `json:"sub_pipeline,omitempty"`
+	Outcome     int                    `json:"outcome"`
+	Payload     map[string]interface{} `json:"payload"`
+}
+
+func deadLetterSteps(done []completedStep) []deadLetterStep {
+	out := make([]deadLetterStep, len(done))
+	for i, c := range done {
+		out[i] = deadLetterStep{Service: c.svc.Name, SubPipeline: viaPath(c.svc.via), Outcome: c.outcome, Payload: c.payload}
+	}
+	return out
+}
+
+// resumeState returns the part of dl's run before its failed service, for continueRun: the payload and
+// steps the service was sent, the outcomes before it, and its completed steps whose service still has a
+// compensate URL in services.
+func resumeState(services []PipelineService, dl DeadLetter) runResult {
+	res := runResult{payload: dl.Payload, steps: dl.Steps}
+	for i, out := range dl.Outcomes {
+		if out.Status == outcomeDeadLetter || out.Status == outcomeFailed {
+			res.outcomes = dl.Outcomes[:i]
+			break
+		}
+	}
+	for _, c := range dl.Completed {
+		if c.Outcome >= len(res.outcomes) {
+			continue
+		}
+		for _, svc := range services {
+			if svc.Name == c.Service && viaPath(svc.via) == c.SubPipeline && svc.Compensate != "" {
+				res.done = append(res.done, completedStep{svc: svc, outcome: c.Outcome, payload: c.Payload})
+				break
+			}
+		}
+	}
+	return res
+}
+
+type deadLetterStore struct {
+	mu sync.Mutex // the file lock only excludes other processes
+}
+
+var deadLetters = &deadLetterStore{}
+
+// deadLetterPath returns DEAD_LETTER_PATH (default deadletters.jsonl).
+func deadLetterPath() string {
+	if p := os.Getenv("DEAD_LETTER_PATH"); p != "" {
+		return p
+	}
+	return "deadletters.jsonl"
+}
+
+// deadLetterMaxAge returns DEAD_LETTER_MAX_AGE (default 168h); 0 keeps dead letters until deleted.
+func deadLetterMaxAge() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("DEAD_LETTER_MAX_AGE")); err == nil && d >= 0 {
+		return d
+	}
+	return 7 * 24 * time.Hour
+}
+
+func readDeadLetters(path string) ([]DeadLetter, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []DeadLetter
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(line), &dl); err != nil {
+			logger.Warn("skipping unreadable dead letter", "path", path, "error", err)
+			continue
+		}
+		out = append(out, dl)
+	}
+	return out, sc.Err()
+}
+
+// unexpired returns the dead letters younger than DEAD_LETTER_MAX_AGE.
+func unexpired(all []DeadLetter) []DeadLetter {
+	maxAge := deadLetterMaxAge()
+	if maxAge == 0 {
+		return all
+	}
+	cutoff := time.Now().Add(-maxAge)
+	out := all[:0:0]
+	for _, dl := range all {
+		if dl.Time.After(cutoff) {
+			out = append(out, dl)
+		}
+	}
+	return out
+}
+
+// list returns the stored dead letters, oldest first.
+func (st *deadLetterStore) list() ([]DeadLetter, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	all, err := readDeadLetters(deadLetterPath())
+	return unexpired(all), err
+}
+
+func (st *deadLetterStore) get(id string) (DeadLetter, error) {
+	all, err := st.list()
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	for _, dl := range all {
+		if dl.ID == id {
+			return dl, nil
+		}
+	}
+	return DeadLetter{}, errDeadLetterNotFound
+}
+
+// update replaces the stored dead letters with what fn returns for them, dropping expired ones.
+func (st *deadLetterStore) update(fn func([]DeadLetter) ([]DeadLetter, error)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	path := deadLetterPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	all, err := readDeadLetters(path)
+	if err != nil {
+		return err
+	}
+	all, err = fn(unexpired(all))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, dl := range all {
+		line, err := json.Marshal(dl)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	return writeFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// delete removes the dead letter id.
+func (st *deadLetterStore) delete(id string) error {
+	return st.update(func(all []DeadLetter) ([]DeadLetter, error) {
+		for i := range all {
+			if all[i].ID == id {
+				return append(all[:i], all[i+1:]...), nil
+			}
+		}
+		return nil, errDeadLetterNotFound
+	})
+}
+
+// claimRetry marks the dead letter id as being retried and returns it. The claim is stored with it, so
+// replicas sharing DEAD_LETTER_PATH see it too; it lasts until endRetry, or deadLetterRetryClaim.
+func (st *deadLetterStore) claimRetry(id string) (DeadLetter, error) {
+	var dl DeadLetter
+	err := st.update(func(all []DeadLetter) ([]DeadLetter, error) {
+		for i := range all {
+			if all[i].ID != id {
+				continue
+			}
+			now := time.Now().UTC()
+			if all[i].RetryingUntil != nil && now.Before(*all[i].RetryingUntil) {
+				return nil, errDeadLetterRetrying
+			}
+			until := now.Add(deadLetterRetryClaim)
+			all[i].RetryingUntil = &until
+			dl = all[i]
+			return all, nil
+		}
+		return nil, errDeadLetterNotFound
+	})
+	return dl, err
+}
+
+// endRetry releases the claim of claimRetry.
+func (st *deadLetterStore) endRetry(id string) {
+	err := st.update(func(all []DeadLetter) ([]DeadLetter, error) {
+		for i := range all {
+			if all[i].ID == id {
+				all[i].RetryingUntil = nil
+			}
+		}
+		return all, nil
+	})
+	if err != nil {
+		logger.Error("failed to release dead letter retry", "id", id, "error", err)
+	}
+}
+
+func newDeadLetterID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// deadLetterRun stores res when a service with on_error: dead_letter stopped it, and sets its deadLetterID.
+func deadLetterRun(ctx context.Context, rp resolvedPipeline, traceID string, input map[string]interface{}, res *runResult) {
+	if res.status != runDeadLetter {
+		return
+	}
+	dl := DeadLetter{
+		ID:              newDeadLetterID(),
+		Time:            time.Now().UTC(),
+		Pipeline:        rp.Name,
+		PipelineVersion: rp.Version,
+		TraceID:         traceID,
+		Service:         res.failed.Service,
+		SubPipeline:     res.failed.Pipeline,
+		Step:            res.failedAt,
+		Error:           res.failed.Error,
+		Input:           input,
+		Payload:         res.payload,
+		Steps:           res.steps,
+		Outcomes:        res.outcomes,
+		Completed:       deadLetterSteps(res.done),
+	}
+	if err := deadLetters.update(func(all []DeadLetter) ([]DeadLetter, error) { return append(all, dl), nil }); err != nil {
+		logger.ErrorContext(ctx, "failed to store dead letter", "service", dl.Service, "error", err)
+		return
+	}
+	res.deadLetterID = dl.ID
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("deadletter.id", dl.ID))
+	logger.WarnContext(ctx, "pipeline run dead-lettered", "id", dl.ID, "service", dl.Service, "error", dl.Error)
+}
+
+// resumeIndex returns where in services the run of dl resumes: the failed service, at its recorded index
+// if the config did not move it, else wherever it now is; -1 if it was removed.
+func resumeIndex(services []PipelineService, dl DeadLetter) int {
+	at := func(i int) bool {
+		return services[i].Name == dl.Service && viaPath(services[i].via) == dl.SubPipeline
+	}
+	if dl.Step >= 0 && dl.Step < len(services) && at(dl.Step) {
+		return dl.Step
+	}
+	for i := range services {
+		if at(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+// apiDeadLetterList returns the dead letters, newest first; ?pipeline= selects one pipeline.
+func apiDeadLetterList(w http.ResponseWriter, r *http.Request) {
+	all, err := deadLetters.list()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		replyJSON(w, map[string]interface{}{"detail": err.Error()})
+		return
+	}
+	pipeline := r.URL.Query().Get("pipeline")
+	out := make([]DeadLetter, 0, len(all))
+	for _, dl := range all {
+		if pipeline == "" || dl.Pipeline == pipeline {
+			out = append(out, dl)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	replyJSON(w, map[string]interface{}{"deadletters": out, "max_age": deadLetterMaxAge().String()})
+}
+
+func apiDeadLetterGet(w http.ResponseWriter, r *http.Request) {
+	dl, err := deadLetters.get(chi.URLParam(r, "id"))
+	if errors.Is(err, errDeadLetterNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"detail": "Dead letter not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		replyJSON(w, map[string]interface{}{"detail": err.Error()})
+		return
+	}
+	replyJSON(w, dl)
+}
+
+func apiDeadLetterDelete(w http.ResponseWriter, r *http.Request) {
+	err := deadLetters.delete(chi.URLParam(r, "id"))
+	if errors.Is(err, errDeadLetterNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Dead letter not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": err.Error()})
+		return
+	}
+	replyJSON(w, map[string]interface{}{"ok": true})
+}
+
+// apiDeadLetterRetry resumes a dead-lettered run at its failed service. A run that completes removes the
+// dead letter; one that fails again updates it to the new failure point.
+func apiDeadLetterRetry(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	dl, err := deadLetters.claimRetry(id)
+	if errors.Is(err, errDeadLetterRetrying) {
+		w.WriteHeader(http.StatusConflict)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Dead letter is already being retried"})
+		return
+	}
+	if errors.Is(err, errDeadLetterNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Dead letter not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": err.Error()})
+		return
+	}
+	released := false
+	defer func() {
+		if !released {
+			deadLetters.endRetry(id)
+		}
+	}()
+	rp, ok := ResolvePipeline(dl.Pipeline)
+	if !ok {
+		w.WriteHeader(http.StatusConflict)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Pipeline not found: " + dl.Pipeline})
+		return
+	}
+	from := resumeIndex(rp.Services, dl)
+	if from < 0 {
+		w.WriteHeader(http.StatusConflict)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Service no longer in the pipeline: " + dl.Service})
+		return
+	}
+
+	ctx, span := otel.Tracer("gateway").Start(r.Context(), "deadletter/retry", pipelineSpanAttrs(rp), trace.WithAttributes(
+		attribute.String("deadletter.id", id),
+		attribute.String("deadletter.trace_id", dl.TraceID),
+		attribute.String("deadletter.service", dl.Service),
+	))
+	defer span.End()
+	ctx = withRunHeaders(withRunBaggage(ctx, r, dl.Input), r)
+	traceID := span.SpanContext().TraceID().String()
+	runStart := time.Now()
+	res := continueRun(ctx, rp.Services[from:], resumeState(rp.Services, dl), nil)
+	pipelineMetrics.RecordRun(ctx, "retry", res.status, runStart)
+
+	err = deadLetters.update(func(all []DeadLetter) ([]DeadLetter, error) {
+		for i := range all {
+			if all[i].ID != id {
+				continue
+			}
+			if res.failed == nil {
+				return append(all[:i], all[i+1:]...), nil
+			}
+			now := time.Now().UTC()
+			d := &all[i]
+			d.PipelineVersion, d.TraceID = rp.Version, traceID
+			d.Service, d.SubPipeline, d.Step, d.Error = res.failed.Service, res.failed.Pipeline, from+res.failedAt, res.failed.Error
+			d.Payload, d.Steps, d.Outcomes, d.Completed = res.payload, res.steps, res.outcomes, deadLetterSteps(res.done)
+			d.Retries++
+			d.LastRetry, d.RetryingUntil = &now, nil
+			res.deadLetterID = id
+			return all, nil
+		}
+		return all, nil // deleted or expired while it ran
+	})
+	released = err == nil
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to update dead letter", "id", id, "error", err)
+	}
+	logger.InfoContext(ctx, "dead letter retried", "id", id, "from", dl.Service, "status", res.status)
+	flushTracer()
+	replyJSON(w, runResponse(traceID, rp, res))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumeIndex(t *testing.T) {
+	svc := func(name string, via ...string) PipelineService {
+		s := PipelineService{Name: name}
+		for _, v := range via {
+			s.via = append(s.via, subPipelineRef{Name: v, Entry: v})
+		}
+		return s
+	}
+	tests := []struct {
+		name     string
+		services []PipelineService
+		dl       DeadLetter
+		want     int
+	}{
+		{name: "at its recorded step", services: []PipelineService{svc("a"), svc("b"), svc("c")}, dl: DeadLetter{Service: "b", Step: 1}, want: 1},
+		{name: "moved by a config change", services: []PipelineService{svc("x"), svc("a"), svc("b")}, dl: DeadLetter{Service: "b", Step: 1}, want: 2},
+		{name: "step past the end", services: []PipelineService{svc("b")}, dl: DeadLetter{Service: "b", Step: 5}, want: 0},
+		{name: "removed", services: []PipelineService{svc("a"), svc("c")}, dl: DeadLetter{Service: "b", Step: 1}, want: -1},
+		{
+			name:     "same name in another sub-pipeline",
+			services: []PipelineService{svc("b"), svc("b", "inner"), svc("b", "other")},
+			dl:       DeadLetter{Service: "b", SubPipeline: "inner", Step: 0},
+			want:     1,
+		},
+		{
+			name:     "nested sub-pipeline",
+			services: []PipelineService{svc("b", "inner"), svc("b", "outer", "inner")},
+			dl:       DeadLetter{Service: "b", SubPipeline: "outer/inner", Step: 0},
+			want:     1,
+		},
+		{name: "sub-pipeline no longer used", services: []PipelineService{svc("b")}, dl: DeadLetter{Service: "b", SubPipeline: "inner", Step: 0}, want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resumeIndex(tt.services, tt.dl); got != tt.want {
+				t.Fatalf("resumeIndex = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnexpired(t *testing.T) {
+	now := time.Now()
+	all := []DeadLetter{
+		{ID: "new", Time: now.Add(-time.Minute)},
+		{ID: "day", Time: now.Add(-25 * time.Hour)},
+		{ID: "week", Time: now.Add(-8 * 24 * time.Hour)},
+	}
+	tests := []struct {
+		maxAge string // DEAD_LETTER_MAX_AGE
+		want   []string
+	}{
+		{maxAge: "", want: []string{"new", "day"}}, // default 168h
+		{maxAge: "24h", want: []string{"new"}},
+		{maxAge: "1s", want: nil},
+		{maxAge: "0", want: []string{"new", "day", "week"}},
+		{maxAge: "bogus", want: []string{"new", "day"}},
+		{maxAge: "-1h", want: []string{"new", "day"}},
+	}
+	for _, tt := range tests {
+		t.Run("max age "+tt.maxAge, func(t *testing.T) {
+			t.Setenv("DEAD_LETTER_MAX_AGE", tt.maxAge)
+			var got []string
+			for _, dl := range unexpired(all) {
+				got = append(got, dl.ID)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("unexpired = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResumeState(t *testing.T) {
+	services := []PipelineService{
+		{Name: "reserve", Compensate: "http://reserve/undo"},
+		{Name: "log"},
+		{Name: "charge", Compensate: "http://charge/undo", via: []subPipelineRef{{Name: "billing", Entry: "billing"}}},
+		{Name: "ship"},
+	}
+	payload := map[string]interface{}{"data": "x"}
+	outcomes := []stepOutcome{
+		{Service: "reserve", Status: outcomeOK},
+		{Service: "log", Status: outcomeSkipped},
+		{Service: "charge", Pipeline: "billing", Status: outcomeOK},
+		{Service: "ship", Status: outcomeDeadLetter},
+	}
+	tests := []struct {
+		name         string
+		outcomes     []stepOutcome
+		completed    []deadLetterStep
+		wantOutcomes int
+		wantDone     []string
+	}{
+		{
+			name:     "outcomes before the failed step, completed steps to compensate",
+			outcomes: outcomes,
+			completed: []deadLetterStep{
+				{Service: "reserve", Outcome: 0, Payload: payload},
+				{Service: "charge", SubPipeline: "billing", Outcome: 2, Payload: payload},
+			},
+			wantOutcomes: 3,
+			wantDone:     []string{"reserve", "charge"},
+		},
+		{
+			name:         "service without a compensate URL any more",
+			outcomes:     outcomes,
+			completed:    []deadLetterStep{{Service: "log", Outcome: 1}},
+			wantOutcomes: 3,
+		},
+		{
+			name:         "service moved to another sub-pipeline",
+			outcomes:     outcomes,
+			completed:    []deadLetterStep{{Service: "charge", Outcome: 2}},
+			wantOutcomes: 3,
+		},
+		{
+			name:         "completed step without its outcome",
+			outcomes:     []stepOutcome{outcomes[0], outcomes[3]},
+			completed:    []deadLetterStep{{Service: "reserve", Outcome: 0}, {Service: "charge", SubPipeline: "billing", Outcome: 2}},
+			wantOutcomes: 1,
+			wantDone:     []string{"reserve"},
+		},
+		{
+			name:         "failed before any step",
+			outcomes:     []stepOutcome{{Service: "reserve", Status: outcomeFailed}},
+			wantOutcomes: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dl := DeadLetter{Payload: payload, Steps: []interface{}{"step"}, Outcomes: tt.outcomes, Completed: tt.completed}
+			res := resumeState(services, dl)
+			if res.payload["data"] != "x" || len(res.steps) != 1 {
+				t.Fatalf("resumed with payload %v and steps %v, want the dead letter's", res.payload, res.steps)
+			}
+			if len(res.outcomes) != tt.wantOutcomes {
+				t.Fatalf("resumed with %d outcomes, want %d", len(res.outcomes), tt.wantOutcomes)
+			}
+			var done []string
+			for _, c := range res.done {
+				done = append(done, c.svc.Name)
+				if c.svc.Compensate == "" {
+					t.Fatalf("completed step %s resumed without its compensate URL", c.svc.Name)
+				}
+			}
+			if strings.Join(done, ",") != strings.Join(tt.wantDone, ",") {
+				t.Fatalf("steps to compensate = %v, want %v", done, tt.wantDone)
+			}
+		})
+	}
+}
+
+// Retries are claimed in the shared file, so two gateways (here two stores) cannot run one at once.
+func TestDeadLetterRetryClaim(t *testing.T) {
+	t.Setenv("DEAD_LETTER_PATH", filepath.Join(t.TempDir(), "deadletters.jsonl"))
+	past := time.Now().Add(-time.Minute)
+	one, other := &deadLetterStore{}, &deadLetterStore{}
+	err := one.update(func(all []DeadLetter) ([]DeadLetter, error) {
+		return append(all, DeadLetter{ID: "a", Time: time.Now()}, DeadLetter{ID: "stale", Time: time.Now(), RetryingUntil: &past}), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dl, err := one.claimRetry("a")
+	if err != nil || dl.ID != "a" || dl.RetryingUntil == nil {
+		t.Fatalf("first claim: %+v, %v", dl, err)
+	}
+	if _, err := other.claimRetry("a"); !errors.Is(err, errDeadLetterRetrying) {
+		t.Fatalf("claim while another retry runs: got %v, want errDeadLetterRetrying", err)
+	}
+	one.endRetry("a")
+	if _, err := other.claimRetry("a"); err != nil {
+		t.Fatalf("claim after the retry ended: %v", err)
+	}
+	if _, err := one.claimRetry("stale"); err != nil {
+		t.Fatalf("claim of an expired claim: %v", err)
+	}
+	if _, err := one.claimRetry("missing"); !errors.Is(err, errDeadLetterNotFound) {
+		t.Fatalf("claim of an unknown id: got %v, want errDeadLetterNotFound", err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A service url or endpoint may name a discovery source instead of a fixed base URL:
+//
+//	srv+http://_transformer._tcp.svc   DNS SRV lookup; one http endpoint per target of the lowest priority
+//	file:///etc/tracems/endpoints.yaml  a JSON/YAML list of base URLs (or {endpoints: [...]})
+//	file:///etc/tracems/endpoints.yaml#transformer  the transformer key of a map of name -> list
+//	registry:transformer                the live instances registered as transformer (see registry.go)
+//
+// Each source is re-resolved every DISCOVERY_REFRESH_INTERVAL (files also when they change; the registry on
+// every call) and feeds the service's balancer, so instances can come and go without editing the pipeline.
+
+// isDiscoveryURL reports whether u names a discovery source rather than a base URL. "file:8080" is a host
+// called file, not a file.
+func isDiscoveryURL(u string) bool {
+	if rest, ok := strings.CutPrefix(u, "file:"); ok {
+		return rest != "" && (rest[0] < '0' || rest[0] > '9')
+	}
+	return strings.HasPrefix(u, "srv+") || strings.HasPrefix(u, "registry:")
+}
+
+func discoveryRefreshInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("DISCOVERY_REFRESH_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return 10 * time.Second
+}
+
+// discoveryFileDir is the directory file: discovery sources must be in (DISCOVERY_FILE_DIR, default the
+// directory of the config file). Discovery URLs come from the API too, so they must not read any file the
+// gateway can.
+func discoveryFileDir() string {
+	dir := os.Getenv("DISCOVERY_FILE_DIR")
+	if dir == "" {
+		dir = includeDir()
+	}
+	abs, _ := filepath.Abs(dir)
+	return abs
+}
+
+// discoverySpec is a parsed discovery URL.
+type discoverySpec struct {
+	kind   string // srv, file or registry
+	scheme string // srv: scheme of the discovered endpoints
+	name   string // srv: the SRV record name; registry: the registered name
+	path   string // file: absolute path
+	key    string // file: map key (URL fragment), "" for a plain list
+}
+
+func parseDiscoveryURL(raw string) (discoverySpec, error) {
+	if name, ok := registryName(raw); ok {
+		if name == "" {
+			return discoverySpec{}, errors.New("registry URL must be registry:<name>")
+		}
+		return discoverySpec{kind: "registry", name: name}, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return discoverySpec{}, errors.New("malformed discovery URL") // not err: it quotes raw
+	}
+	if scheme, ok := strings.CutPrefix(u.Scheme, "srv+"); ok {
+		if scheme != "http" && scheme != "https" {
+			return discoverySpec{}, errors.New("SRV discovery scheme must be srv+http or srv+https")
+		}
+		if u.Host == "" || u.Port() != "" || (u.Path != "" && u.Path != "/") {
+			return discoverySpec{}, errors.New("SRV discovery URL must be srv+http://<record name>")
+		}
+		return discoverySpec{kind: "srv", scheme: scheme, name: u.Host}, nil
+	}
+	if u.Scheme == "file" {
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return discoverySpec{}, errors.New("file discovery URL has no path")
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(includeDir(), path)
+		}
+		path, _ = filepath.Abs(path)
+		if rel, err := filepath.Rel(discoveryFileDir(), path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return discoverySpec{}, errors.New("file discovery path must be inside DISCOVERY_FILE_DIR")
+		}
+		return discoverySpec{kind: "file", path: path, key: u.Fragment}, nil
+	}
+	return discoverySpec{}, fmt.Errorf("unknown discovery scheme %q", u.Scheme)
+}
+
+// lookup returns the base URLs the source currently lists.
+func (d discoverySpec) lookup(ctx context.Context) ([]string, error) {
+	if d.kind == "registry" {
+		return registry.urls(d.name), nil
+	}
+	if d.kind == "srv" {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.name)
+		if err != nil {
+			return nil, err
+		}
+		var out []string
+		for _, r := range records {
+			// LookupSRV sorts by priority; only the lowest priority is used, like any SRV client.
+			if r.Priority != records[0].Priority {
+				break
+			}
+			host := strings.TrimSuffix(r.Target, ".")
+			out = append(out, d.scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(r.Port))))
+		}
+		return out, nil
+	}
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	if d.key == "" {
+		if err := yaml.Unmarshal(data, &list); err != nil {
+			var doc struct {
+				Endpoints []string `yaml:"endpoints"`
+			}
+			if err2 := yaml.Unmarshal(data, &doc); err2 != nil {
+				return nil, err
+			}
+			list = doc.Endpoints
+		}
+	} else {
+		var m map[string][]string
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		var ok bool
+		if list, ok = m[d.key]; !ok {
+			return nil, fmt.Errorf("no %q key", d.key)
+		}
+	}
+	return normalizeURLs(list), nil
+}
+
+// discoveredSource keeps the last endpoints of one discovery URL. It refreshes in the background while
+// balancers keep asking for it, and is dropped after a few idle intervals.
+type discoveredSource struct {
+	raw        string
+	spec       discoverySpec
+	ready      chan struct{} // closed when the first lookup has finished
+	refreshing sync.Mutex    // one lookup at a time
+
+	mu       sync.Mutex
+	urls     []string
+	err      error
+	lastUsed time.Time
+}
+
+// discoverySources holds the sources in use; each has its refresh loop running.
+var discoverySources = struct {
+	sync.Mutex
+	byURL map[string]*discoveredSource
+}{byURL: make(map[string]*discoveredSource)}
+
+// discoveryLookupTimeout bounds one lookup, and how long the first use of a source waits for it.
+const discoveryLookupTimeout = 5 * time.Second
+
+// discoverySource returns the source of the discovery URL raw, marked as used, creating it and starting
+// its refresh loop on first use. Invalid URLs are not kept: validation rejects them, so one only shows up
+// when the environment changed (e.g. DISCOVERY_FILE_DIR) and the config is fixed by the next write.
+func discoverySource(raw string) (*discoveredSource, error) {
+	discoverySources.Lock()
+	defer discoverySources.Unlock()
+	src, ok := discoverySources.byURL[raw]
+	if !ok {
+		spec, err := parseDiscoveryURL(raw)
+		if err != nil {
+			return nil, err
+		}
+		src = &discoveredSource{raw: raw, spec: spec, ready: make(chan struct{})}
+		discoverySources.byURL[raw] = src
+		go src.run()
+	}
+	src.mu.Lock()
+	src.lastUsed = time.Now()
+	src.mu.Unlock()
+	return src, nil
+}
+
+// discoveredURLs returns the current endpoints of the discovery URL raw. Only the first use of a source
+// waits for a lookup; later ones return the last good list, which a failed refresh keeps. An invalid or
+// unresolvable source yields no endpoints.
+func discoveredURLs(raw string) []string {
+	src, err := discoverySource(raw)
+	if err != nil {
+		logger.Warn("invalid discovery URL", "url", raw, "error", err)
+		return nil
+	}
+	select {
+	case <-src.ready:
+	case <-time.After(discoveryLookupTimeout):
+	}
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	return src.urls
+}
+
+// refresh re-resolves the source. Callers asking for its endpoints meanwhile get the previous ones.
+func (src *discoveredSource) refresh() {
+	src.refreshing.Lock()
+	defer src.refreshing.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryLookupTimeout)
+	defer cancel()
+	urls, err := src.spec.lookup(ctx)
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if err != nil {
+		if src.err == nil || src.err.Error() != err.Error() {
+			logger.Warn("service discovery failed; keeping last endpoints", "url", src.raw, "endpoints", len(src.urls), "error", err)
+		}
+		src.err = err
+		return
+	}
+	sort.Strings(urls)
+	if src.err != nil || strings.Join(urls, ",") != strings.Join(src.urls, ",") {
+		logger.Info("service discovery updated", "url", src.raw, "endpoints", urls)
+	}
+	src.urls, src.err = urls, nil
+}
+
+// run refreshes now, then every DISCOVERY_REFRESH_INTERVAL, and file sources also on change, until the
+// source has not been used for five intervals; then it drops the source, so the next use starts afresh.
+func (src *discoveredSource) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	src.refresh()
+	select {
+	case <-src.ready:
+	default:
+		close(src.ready)
+	}
+	interval := discoveryRefreshInterval()
+	if src.spec.kind == "file" {
+		if err := watchFile(ctx, src.spec.path, src.refresh); err != nil {
+			logger.Warn("cannot watch endpoints file; polling only", "path", src.spec.path, "error", err)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// discoverySource marks a source used under the same lock, so none is handed out as it is dropped.
+		discoverySources.Lock()
+		src.mu.Lock()
+		idle := time.Since(src.lastUsed) > 5*interval
+		src.mu.Unlock()
+		if idle {
+			delete(discoverySources.byURL, src.raw)
+		}
+		discoverySources.Unlock()
+		if idle {
+			return
+		}
+		src.refresh()
+	}
+}
+
+// resolveEndpoints expands the discovery URLs among urls into the endpoints they currently list.
+func resolveEndpoints(urls []string) []string {
+	var out []string
+	seen := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		list := []string{u}
+		if name, ok := registryName(u); ok {
+			list = registry.urls(name) // in memory
+		} else if isDiscoveryURL(u) {
+			list = discoveredURLs(u)
+		}
+		for _, e := range list {
+			e = strings.TrimRight(e, "/")
+			if !seen[e] {
+				seen[e] = true
+				out = append(out, e)
+			}
+		}
+	}
+	return out
+}
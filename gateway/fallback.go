@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A service with a fallback keeps the run going when the service fails after its retries, or is skipped
+// because its circuit is open. Exactly one of:
+//
+//	fallback: {url: http://transformer-lite:8002}   call this service instead
+//	fallback: {payload: {type: text, data: ""}}     use this payload as the step's output
+//	fallback: {pass_through: true}                  continue with the step's input unchanged
+//
+// The step is reported with status "fallback" and the primary's error.
+
+// ServiceFallback is what a failed service is replaced with.
+type ServiceFallback struct {
+	URL         string                 `json:"url,omitempty" yaml:"url,omitempty"`
+	Payload     map[string]interface{} `json:"payload,omitempty" yaml:"payload,omitempty"`
+	PassThrough bool                   `json:"pass_through,omitempty" yaml:"pass_through,omitempty"`
+}
+
+// Fallback kinds, reported as "fallback" in steps.
+const (
+	fallbackURL         = "url"
+	fallbackPayload     = "payload"
+	fallbackPassThrough = "pass_through"
+)
+
+func (f *ServiceFallback) kind() string {
+	switch {
+	case f.URL != "":
+		return fallbackURL
+	case f.Payload != nil:
+		return fallbackPayload
+	case f.PassThrough:
+		return fallbackPassThrough
+	}
+	return ""
+}
+
+// check returns what is wrong with f, or "".
+func (f *ServiceFallback) check() string {
+	n := 0
+	for _, set := range []bool{f.URL != "", f.Payload != nil, f.PassThrough} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return "fallback needs exactly one of url, payload or pass_through"
+	}
+	return ""
+}
+
+// normalizeFallback normalizes the URL of f; an empty fallback ({}) is none.
+func normalizeFallback(f *ServiceFallback) *ServiceFallback {
+	if f == nil || f.kind() == "" {
+		return nil
+	}
+	out := *f
+	out.URL = NormalizeURL(out.URL)
+	return &out
+}
+
+// fallbackTarget is the service the fallback url of svc is balanced as.
+func fallbackTarget(svc PipelineService) PipelineService {
+	return PipelineService{Name: svc.Name + " (fallback)", URL: svc.Fallback.URL}
+}
+
+// runFallback replaces the failed call of svc (primary is its error) and returns a reply in the form
+// services send: the payload and the steps with an entry for this step.
+func runFallback(ctx context.Context, client *http.Client, svc PipelineService, body []byte, payload map[string]interface{}, steps []interface{}, primary error) (map[string]interface{}, error) {
+	fb := svc.Fallback
+	kind := fb.kind()
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("fallback", trace.WithAttributes(attribute.String("fallback", kind), attribute.String("error", primary.Error())))
+	span.SetAttributes(attribute.String("step.fallback", kind))
+	logger.WarnContext(ctx, "pipeline step failed; using fallback", "service", svc.Name, "fallback", kind, "error", primary)
+
+	entry := map[string]interface{}{"service": svc.Name, "input": previewPayload(payload)}
+	if kind != fallbackURL {
+		out := payload
+		if kind == fallbackPayload {
+			// A copy: the config's map is shared by every run. Metadata defaults to the input's.
+			out = map[string]interface{}{"type": "text", "data": "", "metadata": payload["metadata"]}
+			for k, v := range fb.Payload {
+				out[k] = v
+			}
+		}
+		entry["output"] = previewPayload(out)
+		return map[string]interface{}{"payload": out, "steps": append(steps[:len(steps):len(steps)], entry)}, nil
+	}
+
+	lb := balancerFor(fallbackTarget(svc))
+	resp, err := PostWithRetryAndCircuit(ctx, client, lb, "/", "application/json", body, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%w: %s", &httpStatusError{status: resp.StatusCode}, b)
+	}
+	var data map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if s, ok := data["steps"].([]interface{}); !ok || len(s) <= len(steps) {
+		// The fallback service did not add a step of its own; add one so the step can be reported.
+		entry["output"] = previewPayload(normalizeIncoming(data))
+		data["steps"] = append(steps[:len(steps):len(steps)], entry)
+	}
+	return data, nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// lockFile is a no-op where flock is unavailable; writes are still serialized within one gateway process.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -5,20 +5,25 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// postWithTrace performs a POST with the current trace context injected so downstream services continue the same trace.
+// postWithTrace performs a POST with the current trace context and baggage injected so downstream services
+// continue the same trace and see the run's baggage entries.
 func postWithTrace(ctx context.Context, client *http.Client, url, contentType string, body io.Reader) (*http.Response, error) {
 	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
@@ -30,7 +35,7 @@ func postWithTrace(ctx context.Context, client *http.Client, url, contentType st
 }
 
 func flushTracer() {
-	if p, ok := otel.GetTracerProvider().(*trace.TracerProvider); ok {
+	if p, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider); ok {
 		_ = p.ForceFlush(context.Background())
 	}
 }
@@ -43,10 +48,6 @@ func svcIcon(s string) string {
 	return s
 }
 
-const (
-	jaegerBase = "http://localhost:16686"
-)
-
 // ProcessRequestLegacy is { "text": "..." }.
 type ProcessRequestLegacy struct {
 	Text *string `json:"text"`
@@ -61,12 +62,24 @@ type ProcessRequest struct {
 
 // PipelineServiceUpdate is one service in PUT /api/pipeline.
 type PipelineServiceUpdate struct {
-	Name        string  `json:"name"`
-	URL         string  `json:"url"`
-	Icon        string  `json:"icon"`
-	Description string  `json:"description"`
-	InputType   *string `json:"input_type"`
-	OutputType  *string `json:"output_type"`
+	Name        string           `json:"name"`
+	URL         string           `json:"url"`
+	Icon        string           `json:"icon"`
+	Description string           `json:"description"`
+	InputType   *string          `json:"input_type"`
+	OutputType  *string          `json:"output_type"`
+	Pipeline    string           `json:"pipeline,omitempty"`
+	Include     string           `json:"include,omitempty"`
+	Endpoints   []string         `json:"endpoints,omitempty"`
+	Balance     string           `json:"balance,omitempty"`
+	HashKey     string           `json:"hash_key,omitempty"`
+	Variants    []ServiceVariant `json:"variants,omitempty"`
+	StickyKey   string           `json:"sticky_key,omitempty"`
+	Shadow      string           `json:"shadow,omitempty"`
+	Hedge       *HedgePolicy     `json:"hedge,omitempty"`
+	Fallback    *ServiceFallback `json:"fallback,omitempty"`
+	OnError     string           `json:"on_error,omitempty"`
+	Compensate  string           `json:"compensate,omitempty"`
 }
 
 // PipelineUpdate is PUT /api/pipeline body.
@@ -74,81 +87,192 @@ type PipelineUpdate struct {
 	Services []PipelineServiceUpdate `json:"services"`
 }
 
-func apiPipelineGet(w http.ResponseWriter, r *http.Request) {
-	svc := LoadPipeline()
-	type svcOut struct {
-		Name        string `json:"name"`
-		URL         string `json:"url"`
-		Icon        string `json:"icon"`
-		Description string `json:"description"`
-		InputType   string `json:"input_type"`
-		OutputType  string `json:"output_type"`
-	}
-	out := make([]svcOut, len(svc))
+// pipelineServiceOut is one service as returned by GET /api/pipeline.
+type pipelineServiceOut struct {
+	Name        string           `json:"name"`
+	URL         string           `json:"url"`
+	Icon        string           `json:"icon"`
+	Description string           `json:"description"`
+	InputType   string           `json:"input_type"`
+	OutputType  string           `json:"output_type"`
+	Pipeline    string           `json:"pipeline,omitempty"`
+	Include     string           `json:"include,omitempty"`
+	Endpoints   []string         `json:"endpoints,omitempty"`
+	Balance     string           `json:"balance,omitempty"`
+	HashKey     string           `json:"hash_key,omitempty"`
+	Variants    []ServiceVariant `json:"variants,omitempty"`
+	StickyKey   string           `json:"sticky_key,omitempty"`
+	Shadow      string           `json:"shadow,omitempty"`
+	Hedge       *HedgePolicy     `json:"hedge,omitempty"`
+	Fallback    *ServiceFallback `json:"fallback,omitempty"`
+	OnError     string           `json:"on_error,omitempty"`
+	Compensate  string           `json:"compensate,omitempty"`
+}
+
+func pipelineServicesOut(svc []PipelineService) []pipelineServiceOut {
+	out := make([]pipelineServiceOut, len(svc))
 	for i := range svc {
-		out[i] = svcOut{
+		out[i] = pipelineServiceOut{
 			Name:        svc[i].Name,
 			URL:         svc[i].URL,
 			Icon:        svcIcon(svc[i].Icon),
 			Description: svc[i].Description,
 			InputType:   svc[i].InputType,
 			OutputType:  svc[i].OutputType,
+			Pipeline:    svc[i].Pipeline,
+			Include:     svc[i].Include,
+			Endpoints:   svc[i].Endpoints,
+			Balance:     svc[i].Balance,
+			HashKey:     svc[i].HashKey,
+			Variants:    svc[i].Variants,
+			StickyKey:   svc[i].StickyKey,
+			Shadow:      svc[i].Shadow,
+			Hedge:       svc[i].Hedge,
+			Fallback:    svc[i].Fallback,
+			OnError:     svc[i].OnError,
+			Compensate:  svc[i].Compensate,
 		}
 	}
-	replyJSON(w, map[string]interface{}{"services": out})
+	return out
+}
+
+func apiPipelineGet(w http.ResponseWriter, r *http.Request) {
+	ps := loadPipelineSet()
+	w.Header().Set("ETag", pipelineETag(ps))
+	replyJSON(w, map[string]interface{}{"services": pipelineServicesOut(ps.Pipelines[ps.Default])})
 }
 
 func apiPipelinePut(w http.ResponseWriter, r *http.Request) {
+	if !requireIfMatch(w, r) {
+		return
+	}
 	var body PipelineUpdate
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Invalid JSON"})
 		return
 	}
-	if len(body.Services) == 0 {
-		replyJSON(w, map[string]interface{}{"ok": false, "detail": "At least one service required"})
+	svc, detail := servicesFromUpdate(body)
+	if detail != "" {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": detail})
 		return
 	}
-	seen := make(map[string]bool)
-	svc := make([]PipelineService, 0, len(body.Services))
-	for _, s := range body.Services {
-		name := strings.TrimSpace(s.Name)
-		if name == "" {
-			replyJSON(w, map[string]interface{}{"ok": false, "detail": "Service name is required"})
-			return
-		}
-		if seen[name] {
-			replyJSON(w, map[string]interface{}{"ok": false, "detail": "Duplicate service name: " + name})
-			return
-		}
-		seen[name] = true
-		icon := strings.TrimSpace(s.Icon)
-		if icon == "" {
-			icon = "•"
-		}
-		desc := strings.TrimSpace(s.Description)
-		var inputType, outputType string
-		if s.InputType != nil {
-			inputType = strings.TrimSpace(*s.InputType)
-		}
-		if s.OutputType != nil {
-			outputType = strings.TrimSpace(*s.OutputType)
-		}
-		svc = append(svc, PipelineService{
-			Name:        name,
-			URL:         NormalizeURL(s.URL),
-			Icon:        icon,
-			Description: desc,
-			InputType:   inputType,
-			OutputType:  outputType,
-		})
+	if !validateForWrite(w, r, "", svc) {
+		return
+	}
+	res, err := SetPipeline(svc, changeMetaFromRequest(r))
+	if replyPreconditionFailed(w, err) || replyInvalidPipeline(w, err) {
+		return
 	}
-	err := SetPipeline(svc)
 	if err != nil {
 		replyJSON(w, map[string]interface{}{"ok": true, "saved": false, "detail": err.Error()})
 		return
 	}
-	saved := getWritablePath() != ""
-	replyJSON(w, map[string]interface{}{"ok": true, "saved": saved})
+	w.Header().Set("ETag", res.ETag)
+	saved := storeAuthoritative()
+	replyJSON(w, map[string]interface{}{"ok": true, "saved": saved, "version": res.Version})
+}
+
+// requireIfMatch rejects config writes without an If-Match header with 428, unless
+// PIPELINE_REQUIRE_IF_MATCH=false. Clients get the ETag from GET /api/pipeline; "*" forces the write.
+func requireIfMatch(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("If-Match") != "" || strings.ToLower(os.Getenv("PIPELINE_REQUIRE_IF_MATCH")) == "false" {
+		return true
+	}
+	w.WriteHeader(http.StatusPreconditionRequired)
+	replyJSON(w, map[string]interface{}{"ok": false, "detail": "If-Match header required (use the ETag from GET /api/pipeline)"})
+	return false
+}
+
+// replyPreconditionFailed writes a 412 with the current ETag when err is errPreconditionFailed.
+func replyPreconditionFailed(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, errPreconditionFailed) {
+		return false
+	}
+	w.Header().Set("ETag", pipelineETag(loadPipelineSet()))
+	w.WriteHeader(http.StatusPreconditionFailed)
+	replyJSON(w, map[string]interface{}{"ok": false, "detail": err.Error()})
+	return true
+}
+
+// replyInvalidPipeline rejects a change that leaves the config unloadable (e.g. a pipeline reference
+// to a missing pipeline, or a composition cycle) when err is errInvalidPipeline.
+func replyInvalidPipeline(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, errInvalidPipeline) {
+		return false
+	}
+	replyJSON(w, map[string]interface{}{"ok": false, "detail": err.Error()})
+	return true
+}
+
+// servicesFromUpdate validates a PUT body and converts it to pipeline services.
+// Returns a non-empty detail message when the body is invalid.
+func servicesFromUpdate(body PipelineUpdate) ([]PipelineService, string) {
+	svc := make([]PipelineService, 0, len(body.Services))
+	for _, s := range body.Services {
+		svc = append(svc, serviceFromUpdate(s))
+	}
+	if detail := validateServices(svc); detail != "" {
+		return nil, detail
+	}
+	return svc, ""
+}
+
+// serviceFromUpdate trims and normalizes one service from an API body.
+func serviceFromUpdate(s PipelineServiceUpdate) PipelineService {
+	icon := strings.TrimSpace(s.Icon)
+	if icon == "" {
+		icon = "•"
+	}
+	var inputType, outputType string
+	if s.InputType != nil {
+		inputType = strings.TrimSpace(*s.InputType)
+	}
+	if s.OutputType != nil {
+		outputType = strings.TrimSpace(*s.OutputType)
+	}
+	out := PipelineService{
+		Name:        strings.TrimSpace(s.Name),
+		URL:         NormalizeURL(s.URL),
+		Icon:        icon,
+		Description: strings.TrimSpace(s.Description),
+		InputType:   inputType,
+		OutputType:  outputType,
+		Pipeline:    strings.TrimSpace(s.Pipeline),
+		Include:     strings.TrimSpace(s.Include),
+		Endpoints:   normalizeURLs(s.Endpoints),
+		Balance:     strings.TrimSpace(s.Balance),
+		HashKey:     strings.TrimSpace(s.HashKey),
+		Variants:    normalizeVariants(s.Variants),
+		StickyKey:   strings.TrimSpace(s.StickyKey),
+		Shadow:      NormalizeURL(s.Shadow),
+		Hedge:       s.Hedge,
+		Fallback:    normalizeFallback(s.Fallback),
+		OnError:     strings.TrimSpace(s.OnError),
+		Compensate:  NormalizeURL(s.Compensate),
+	}
+	if out.Name == "" && isComposite(out) {
+		out.Name = compositeName(out)
+	}
+	return out
+}
+
+// validateServices checks a complete services list: at least one service, names present and unique.
+// Returns a non-empty detail message when the list is invalid.
+func validateServices(svc []PipelineService) string {
+	if len(svc) == 0 {
+		return "At least one service required"
+	}
+	seen := make(map[string]bool)
+	for _, s := range svc {
+		if s.Name == "" {
+			return "Service name is required"
+		}
+		if seen[s.Name] {
+			return "Duplicate service name: " + s.Name
+		}
+		seen[s.Name] = true
+	}
+	return ""
 }
 
 func health(w http.ResponseWriter, r *http.Request) {
@@ -160,19 +284,42 @@ func healthAll(w http.ResponseWriter, r *http.Request) {
 		{"name": "gateway", "ok": true, "body": map[string]string{"status": "ok", "service": "gateway"}},
 	}
 	client := &http.Client{Timeout: 2 * time.Second}
-	for _, pair := range PipelineNamesURLs() {
-		name, baseURL := pair[0], pair[1]
-		resp, err := client.Get(baseURL + "/health")
-		entry := map[string]interface{}{"name": name}
-		if err != nil {
-			entry["ok"] = false
-			entry["body"] = map[string]string{"error": err.Error()}
-		} else {
-			entry["ok"] = resp.StatusCode >= 200 && resp.StatusCode < 300
-			var body map[string]interface{}
-			_ = json.NewDecoder(resp.Body).Decode(&body)
-			resp.Body.Close()
-			entry["body"] = body
+	for _, svc := range LoadPipeline() {
+		entry := map[string]interface{}{"name": svc.Name, "ok": false}
+		urls := balancerFor(svc).urls()
+		// Endpoints are reported by index, and errors lose their text when the definition holds
+		// ${...} references, so resolved hosts and secrets stay out of the response (as in validate.go).
+		redact := svc.referenced
+		var endpoints []map[string]interface{}
+		for i, baseURL := range urls {
+			resp, err := client.Get(baseURL + "/health")
+			ok := false
+			var body interface{}
+			if err != nil {
+				msg := err.Error()
+				if redact {
+					msg = "Health check failed"
+				}
+				body = map[string]string{"error": msg}
+			} else {
+				ok = resp.StatusCode >= 200 && resp.StatusCode < 300
+				var m map[string]interface{}
+				_ = json.NewDecoder(resp.Body).Decode(&m)
+				resp.Body.Close()
+				body = m
+			}
+			// The service is up if any endpoint is; report the body of the first healthy one.
+			if entry["body"] == nil || (ok && entry["ok"] == false) {
+				entry["ok"] = ok
+				entry["body"] = body
+			}
+			endpoints = append(endpoints, map[string]interface{}{"endpoint": i, "ok": ok})
+		}
+		if len(urls) == 0 {
+			entry["body"] = map[string]string{"error": "no endpoints discovered"}
+		}
+		if len(urls) > 1 || len(urls) != len(svc.endpointURLs()) {
+			entry["endpoints"] = endpoints
 		}
 		results = append(results, entry)
 	}
@@ -180,6 +327,10 @@ func healthAll(w http.ResponseWriter, r *http.Request) {
 }
 
 func processStream(w http.ResponseWriter, r *http.Request) {
+	rp, ok := pipelineForRequest(w, r)
+	if !ok {
+		return
+	}
 	payload, err := parseProcessBody(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -187,9 +338,15 @@ func processStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	tracer := otel.Tracer("gateway")
-	ctx, span := tracer.Start(r.Context(), "process/stream")
+	ctx, span := tracer.Start(r.Context(), "process/stream", pipelineSpanAttrs(rp))
 	defer span.End()
+	ctx = withRunHeaders(withRunBaggage(ctx, r, payload), r)
 	traceID := span.SpanContext().TraceID().String()
+	runStart := time.Now()
+	runStatus := "error"
+	defer func() {
+		pipelineMetrics.RecordRun(ctx, "stream", runStatus, runStart)
+	}()
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -203,61 +360,64 @@ func processStream(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	send("started", map[string]interface{}{"trace_id": traceID, "payload": payload})
-	current := payload
-	steps := []interface{}{}
-	client := &http.Client{Timeout: 120 * time.Second}
-	for _, pair := range PipelineNamesURLs() {
-		name, baseURL := pair[0], pair[1]
-		body := bodyForService(current, steps)
-		bodyReader := mustJSON(body)
-		resp, err := PostWithRetryAndCircuit(ctx, client, baseURL+"/", "application/json", bodyReader, baseURL)
-		if err != nil {
-			send("error", map[string]interface{}{"service": name, "error": err.Error()})
-			return
+	send("started", map[string]interface{}{
+		"trace_id":         traceID,
+		"trace_url":        traceURL(traceID),
+		"pipeline":         rp.Name,
+		"pipeline_version": rp.Version,
+		"payload":          payload,
+	})
+	res := runPipeline(ctx, rp.Services, payload, nil, func(svc PipelineService, call stepCall, outcome stepOutcome) {
+		preview := previewPayload(call.payload)
+		event := map[string]interface{}{
+			"service":      svc.Name,
+			"input":        getStr(call.last, "input", preview),
+			"output":       getStr(call.last, "output", preview),
+			"status":       getStr(call.last, "status", "ok"),
+			"payload_type": getStr(call.payload, "type", "text"),
 		}
-		if resp.StatusCode != http.StatusOK {
-			bodyBytes, _ := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			send("error", map[string]interface{}{"service": name, "error": string(bodyBytes)})
-			return
+		if len(svc.via) > 0 {
+			event["pipeline"] = viaPath(svc.via)
+			event["parent"] = svc.via[0].Entry // the entry of rp's own services list this step belongs to
 		}
-		var data map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-			resp.Body.Close()
-			send("error", map[string]interface{}{"service": name, "error": err.Error()})
-			return
+		if call.variant != "" {
+			event["variant"] = call.variant
 		}
-		resp.Body.Close()
-		current = normalizeIncoming(data)
-		if s, ok := data["steps"].([]interface{}); ok {
-			steps = s
+		if call.fallback != "" {
+			event["fallback"] = call.fallback
 		}
-		lastStep := map[string]interface{}{}
-		if len(steps) > 0 {
-			if m, ok := steps[len(steps)-1].(map[string]interface{}); ok {
-				lastStep = m
-			}
+		if outcome.Error != "" {
+			event["error"] = outcome.Error
 		}
-		preview := previewPayload(current)
-		send("step", map[string]interface{}{
-			"service":      name,
-			"input":        getStr(lastStep, "input", preview),
-			"output":       getStr(lastStep, "output", preview),
-			"status":       getStr(lastStep, "status", "ok"),
-			"payload_type": getStr(current, "type", "text"),
-		})
+		send("step", event)
+	})
+	runStatus = res.status
+	deadLetterRun(ctx, rp, traceID, payload, &res)
+	if res.failed != nil {
+		event := map[string]interface{}{
+			"service":  res.failed.Service,
+			"error":    res.failed.Error,
+			"status":   res.status,
+			"outcomes": res.outcomes,
+		}
+		if res.deadLetterID != "" {
+			event["dead_letter_id"] = res.deadLetterID
+		}
+		if len(res.steps) > 0 {
+			event["steps"] = res.steps // with the results of compensations, if any
+		}
+		send("error", event)
+		return
 	}
 	flushTracer()
-	send("done", map[string]interface{}{
-		"trace_id": traceID,
-		"result":   current["data"],
-		"steps":    steps,
-		"payload":  current,
-	})
+	send("done", runResponse(traceID, rp, res))
 }
 
 func processJSON(w http.ResponseWriter, r *http.Request) {
+	rp, ok := pipelineForRequest(w, r)
+	if !ok {
+		return
+	}
 	payload, err := parseProcessBody(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -265,21 +425,23 @@ func processJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	tracer := otel.Tracer("gateway")
-	ctx, span := tracer.Start(r.Context(), "process/json")
+	ctx, span := tracer.Start(r.Context(), "process/json", pipelineSpanAttrs(rp))
 	defer span.End()
+	ctx = withRunHeaders(withRunBaggage(ctx, r, payload), r)
 	traceID := span.SpanContext().TraceID().String()
-	result := runPipeline(ctx, payload)
+	runStart := time.Now()
+	res := runPipeline(ctx, rp.Services, payload, nil, nil)
+	deadLetterRun(ctx, rp, traceID, payload, &res)
+	pipelineMetrics.RecordRun(ctx, "json", res.status, runStart)
 	flushTracer()
-	replyJSON(w, map[string]interface{}{
-		"trace_id": traceID,
-		"result":   result["result"],
-		"stored":   true,
-		"steps":    result["steps"],
-		"payload":  result["payload"],
-	})
+	replyJSON(w, runResponse(traceID, rp, res))
 }
 
 func processForm(w http.ResponseWriter, r *http.Request) {
+	rp, ok := pipelineForRequest(w, r)
+	if !ok {
+		return
+	}
 	payload := map[string]interface{}{
 		"type":     "text",
 		"data":     "",
@@ -369,18 +531,36 @@ func processForm(w http.ResponseWriter, r *http.Request) {
 		payload["data"] = r.FormValue("text")
 	}
 	tracer := otel.Tracer("gateway")
-	ctx, span := tracer.Start(r.Context(), "process/form")
+	ctx, span := tracer.Start(r.Context(), "process/form", pipelineSpanAttrs(rp))
 	defer span.End()
+	ctx = withRunHeaders(withRunBaggage(ctx, r, payload), r)
 	traceID := span.SpanContext().TraceID().String()
-	result := runPipeline(ctx, payload)
+	runStart := time.Now()
+	res := runPipeline(ctx, rp.Services, payload, nil, nil)
+	deadLetterRun(ctx, rp, traceID, payload, &res)
+	pipelineMetrics.RecordRun(ctx, "form", res.status, runStart)
 	flushTracer()
-	replyJSON(w, map[string]interface{}{
-		"trace_id": traceID,
-		"result":   result["result"],
-		"stored":   true,
-		"steps":    result["steps"],
-		"payload":  result["payload"],
-	})
+	replyJSON(w, runResponse(traceID, rp, res))
+}
+
+// pipelineForRequest resolves the {pipeline} URL parameter (default pipeline when absent).
+// Writes a 404 and returns ok=false when the pipeline does not exist.
+func pipelineForRequest(w http.ResponseWriter, r *http.Request) (resolvedPipeline, bool) {
+	rp, ok := ResolvePipeline(chi.URLParam(r, "pipeline"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"detail": "Pipeline not found: " + rp.Name})
+		return rp, false
+	}
+	return rp, true
+}
+
+// pipelineSpanAttrs tags a run's root span with the pipeline name and config version it used.
+func pipelineSpanAttrs(rp resolvedPipeline) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("pipeline.name", rp.Name),
+		attribute.Int("pipeline.version", rp.Version),
+	)
 }
 
 func parseProcessBody(r *http.Request) (map[string]interface{}, error) {
@@ -459,36 +639,15 @@ func bodyForService(payload map[string]interface{}, steps []interface{}) map[str
 	}
 }
 
-func runPipeline(ctx context.Context, initial map[string]interface{}) map[string]interface{} {
-	payload := initial
-	steps := []interface{}{}
-	client := &http.Client{Timeout: 120 * time.Second}
-	for _, pair := range PipelineNamesURLs() {
-		_, baseURL := pair[0], pair[1]
-		body := bodyForService(payload, steps)
-		bodyReader := mustJSON(body)
-		resp, err := PostWithRetryAndCircuit(ctx, client, baseURL+"/", "application/json", bodyReader, baseURL)
-		if err != nil {
-			return map[string]interface{}{"payload": payload, "steps": steps, "result": payload["data"], "stored": false}
-		}
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			return map[string]interface{}{"payload": payload, "steps": steps, "result": payload["data"], "stored": false}
-		}
-		var data map[string]interface{}
-		_ = json.NewDecoder(resp.Body).Decode(&data)
-		resp.Body.Close()
-		payload = normalizeIncoming(data)
-		if s, ok := data["steps"].([]interface{}); ok {
-			steps = s
-		}
-	}
-	return map[string]interface{}{
-		"payload": payload,
-		"steps":   steps,
-		"result":  payload["data"],
-		"stored":  true,
+// recordStep emits one structured log record for a pipeline step and records its duration metric.
+func recordStep(ctx context.Context, service, status string, start time.Time, err error) {
+	pipelineMetrics.RecordStep(ctx, service, status, start)
+	attrs := []interface{}{"service", service, "status", status, "duration_ms", time.Since(start).Milliseconds()}
+	if err != nil {
+		logger.ErrorContext(ctx, "pipeline step failed", append(attrs, "error", err)...)
+		return
 	}
+	logger.InfoContext(ctx, "pipeline step", attrs...)
 }
 
 func previewPayload(payload map[string]interface{}) string {
@@ -538,11 +697,46 @@ func mustJSON(v interface{}) *bytes.Reader {
 func RegisterRoutes(r chi.Router, staticDir string) {
 	r.Get("/api/pipeline", apiPipelineGet)
 	r.Put("/api/pipeline", apiPipelinePut)
+	r.Post("/api/pipeline/validate", apiPipelineValidate)
+	r.Get("/api/pipeline/events", apiPipelineEvents)
+	r.Get("/api/pipeline/source", apiPipelineSource)
+	r.Get("/api/traces/{traceId}", apiTraceGet)
+	r.Get("/api/registry", apiRegistryList)
+	r.Post("/api/registry", apiRegistryRegister)
+	r.Post("/api/registry/{id}/heartbeat", apiRegistryHeartbeat)
+	r.Delete("/api/registry/{id}", apiRegistryDelete)
+	r.Get("/api/shadow", apiShadowList)
+	r.Delete("/api/shadow", apiShadowReset)
+	r.Get("/api/deadletters", apiDeadLetterList)
+	r.Get("/api/deadletters/{id}", apiDeadLetterGet)
+	r.Post("/api/deadletters/{id}/retry", apiDeadLetterRetry)
+	r.Delete("/api/deadletters/{id}", apiDeadLetterDelete)
+	if traceStoreOTLPIngest() {
+		r.Post("/v1/traces", otlpIngest)
+	}
 	r.Get("/health", health)
 	r.Get("/health/all", healthAll)
 	r.Post("/process/stream", processStream)
 	r.Post("/process/json", processJSON)
 	r.Post("/process", processForm)
+	r.Post("/api/pipeline/services", apiServiceAdd)
+	r.Patch("/api/pipeline/services/{service}", apiServicePatch)
+	r.Delete("/api/pipeline/services/{service}", apiServiceDelete)
+	r.Post("/api/pipeline/services/{service}/move", apiServiceMove)
+	r.Get("/api/pipeline/versions", apiPipelineVersions)
+	r.Get("/api/pipeline/versions/{v}", apiPipelineVersionGet)
+	r.Post("/api/pipeline/rollback/{v}", apiPipelineRollback)
+	r.Get("/api/pipelines", apiPipelinesList)
+	r.Get("/api/pipelines/{name}", apiPipelineNamedGet)
+	r.Put("/api/pipelines/{name}", apiPipelineNamedPut)
+	r.Delete("/api/pipelines/{name}", apiPipelineNamedDelete)
+	r.Post("/api/pipelines/{name}/services", apiServiceAdd)
+	r.Patch("/api/pipelines/{name}/services/{service}", apiServicePatch)
+	r.Delete("/api/pipelines/{name}/services/{service}", apiServiceDelete)
+	r.Post("/api/pipelines/{name}/services/{service}/move", apiServiceMove)
+	r.Post("/process/{pipeline}/stream", processStream)
+	r.Post("/process/{pipeline}/json", processJSON)
+	r.Post("/process/{pipeline}", processForm)
 	if staticDir != "" {
 		r.Handle("/assets/*", http.StripPrefix("/assets", http.FileServer(http.Dir(staticDir+"/assets"))))
 		r.Handle("/favicon.ico", http.FileServer(http.Dir(staticDir)))
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A service with a hedge policy sends a second request (to another endpoint when there is one) if the first
+// has not answered after delay, or after the given percentile of the service's recent latencies. The first
+// successful response wins and the other requests are cancelled. Hedges, like retries, are paid from the
+// service's retry budget, so a slow service is not sent twice the traffic:
+//
+//	hedge: {percentile: 95, delay: 200ms, max: 1}
+
+// HedgePolicy configures hedged requests for a service.
+type HedgePolicy struct {
+	Percentile float64 `json:"percentile,omitempty" yaml:"percentile,omitempty"` // hedge after this latency percentile (e.g. 95)
+	Delay      string  `json:"delay,omitempty" yaml:"delay,omitempty"`           // fixed delay; with percentile, used until there are enough samples
+	Max        int     `json:"max,omitempty" yaml:"max,omitempty"`               // extra requests per attempt (default 1)
+}
+
+const (
+	latencySamples    = 128 // recent successful call latencies kept per balancer
+	minLatencySamples = 20  // samples needed before a percentile delay is used
+	maxHedges         = 3
+)
+
+// check returns what is wrong with h, or "".
+func (h *HedgePolicy) check() string {
+	if h.Percentile == 0 && h.Delay == "" {
+		return "hedge needs a percentile or a delay"
+	}
+	if h.Percentile < 0 || h.Percentile >= 100 {
+		return "hedge percentile must be between 0 and 100"
+	}
+	if h.Delay != "" {
+		if d, err := time.ParseDuration(h.Delay); err != nil || d <= 0 {
+			return fmt.Sprintf("invalid hedge delay %q", h.Delay)
+		}
+	}
+	if h.Max < 0 || h.Max > maxHedges {
+		return fmt.Sprintf("hedge max must be between 1 and %d", maxHedges)
+	}
+	return ""
+}
+
+func (h *HedgePolicy) max() int {
+	if h.Max <= 0 {
+		return 1
+	}
+	return h.Max
+}
+
+// delay returns how long to wait for a response before hedging, or ok=false when lb has too few latency
+// samples for the percentile and no fixed delay is set.
+func (h *HedgePolicy) delay(lb *balancer) (time.Duration, bool) {
+	if h.Percentile > 0 {
+		if d, ok := lb.latencies.percentile(h.Percentile); ok {
+			return max(d, time.Millisecond), true
+		}
+	}
+	d, err := time.ParseDuration(h.Delay)
+	return d, err == nil && d > 0
+}
+
+// latencyWindow keeps the latencies of a balancer's recent successful calls.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < latencySamples {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencySamples
+}
+
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	sorted := append([]time.Duration(nil), w.samples...)
+	w.mu.Unlock()
+	if len(sorted) < minLatencySamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)], true
+}
+
+// retryBudget limits retries and hedges of a service to PIPELINE_RETRY_BUDGET_PERCENT of its calls, plus
+// PIPELINE_RETRY_BUDGET_MIN_PER_SEC so a quiet service can still retry. Each call deposits percent/100 of
+// a token and each retry or hedge withdraws one; at most ten seconds' worth of the minimum is saved up.
+type retryBudget struct {
+	mu      sync.Mutex
+	balance float64
+	last    time.Time
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{balance: retryBudgetCap(), last: time.Now()}
+}
+
+func retryBudgetCap() float64 {
+	return math.Max(10*float64(clientConfig.RetryBudgetMinPerSec), 10)
+}
+
+// refillLocked adds the per-second minimum since the last call. Caller must hold b.mu.
+func (b *retryBudget) refillLocked() {
+	now := time.Now()
+	b.balance = math.Min(retryBudgetCap(), b.balance+now.Sub(b.last).Seconds()*float64(clientConfig.RetryBudgetMinPerSec))
+	b.last = now
+}
+
+// deposit credits one call.
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked()
+	b.balance = math.Min(retryBudgetCap(), b.balance+float64(clientConfig.RetryBudgetPercent)/100)
+}
+
+// withdraw takes one token for a retry or hedge; false means the budget is exhausted.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// errNoEndpoint is returned by sendAttempt when lb has no endpoint to send the first request to.
+var errNoEndpoint = errors.New("no endpoint available")
+
+type attemptResult struct {
+	ep    *endpoint
+	resp  *http.Response
+	err   error
+	start time.Time
+	hedge int // 0 for the first request, n for the n-th hedge
+}
+
+// retryable reports whether the result is a failure worth another attempt.
+func (r attemptResult) retryable() bool {
+	return r.err != nil || r.resp.StatusCode == 429 || (r.resp.StatusCode >= 500 && r.resp.StatusCode < 600)
+}
+
+// sendAttempt makes one attempt of PostWithRetryAndCircuit: a POST to an endpoint picked from lb and, with
+// a hedge policy, up to hedge.max() more to other endpoints while none has answered. The first response
+// that is not retryable is returned and the other requests are cancelled; otherwise the last failure is.
+// Every endpoint used is added to tried. hedges is the number of hedges sent and won whether one of them
+// returned the response.
+func sendAttempt(ctx context.Context, client *http.Client, lb *balancer, path, contentType string, body []byte, key string, tried map[string]bool, hedge *HedgePolicy) (resp *http.Response, hedges int, won bool, err error) {
+	retry := len(tried) > 0
+	ep := lb.pick(ctx, key, tried)
+	if ep == nil && retry {
+		ep = lb.pick(ctx, key, nil) // every endpoint was tried; retry any of them
+	}
+	if ep == nil {
+		return nil, 0, false, errNoEndpoint
+	}
+	if retry {
+		pipelineMetrics.RecordRetry(ctx, ep.url+path)
+	}
+
+	results := make(chan attemptResult, 1+maxHedges)
+	var cancels []context.CancelFunc // per request, by hedge number
+	pending := 0
+	launch := func(ep *endpoint) {
+		tried[ep.url] = true
+		actx, cancel := context.WithCancel(ctx)
+		n := len(cancels)
+		cancels = append(cancels, cancel)
+		pending++
+		start := time.Now()
+		go func() {
+			resp, err := postWithTrace(actx, client, ep.url+path, contentType, bytes.NewReader(body))
+			results <- attemptResult{ep: ep, resp: resp, err: err, start: start, hedge: n}
+		}()
+	}
+	// abandon cancels the requests still in flight (all but keep) and releases their endpoints as they return,
+	// without counting them as successes or failures.
+	abandon := func(keep int) {
+		for i, cancel := range cancels {
+			if i != keep {
+				cancel()
+			}
+		}
+		go func(n int) {
+			for ; n > 0; n-- {
+				r := <-results
+				if r.resp != nil {
+					_ = r.resp.Body.Close()
+				}
+				lb.release(r.ep)
+			}
+		}(pending)
+	}
+	launch(ep)
+
+	span := trace.SpanFromContext(ctx)
+	var timer <-chan time.Time
+	if hedge != nil {
+		if d, ok := hedge.delay(lb); ok {
+			timer = time.After(d)
+		}
+	}
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-timer:
+			timer = nil
+			next := lb.pick(ctx, key, tried)
+			if next == nil {
+				next = lb.pick(ctx, key, nil) // no other endpoint; hedge to the same one
+			}
+			if next == nil {
+				continue
+			}
+			if !lb.budget.withdraw() {
+				lb.release(next)
+				span.AddEvent("hedge skipped: retry budget exhausted")
+				continue
+			}
+			hedges++
+			span.AddEvent("hedge", trace.WithAttributes(attribute.String("endpoint", next.url), attribute.Int("hedge", hedges)))
+			logger.InfoContext(ctx, "hedging service call", "service", lb.service, "endpoint", next.url, "hedge", hedges)
+			pipelineMetrics.RecordHedge(ctx, lb.service)
+			launch(next)
+			if hedges < hedge.max() {
+				if d, ok := hedge.delay(lb); ok {
+					timer = time.After(d)
+				}
+			}
+		case r := <-results:
+			pending--
+			if r.retryable() {
+				if r.resp != nil {
+					_ = r.resp.Body.Close()
+					lastErr = &httpStatusError{status: r.resp.StatusCode}
+				} else {
+					lastErr = r.err
+				}
+				cancels[r.hedge]()
+				circuitBreaker.Failure(ctx, r.ep.url)
+				lb.done(ctx, r.ep, true)
+				continue
+			}
+			abandon(r.hedge)
+			circuitBreaker.Success(ctx, r.ep.url)
+			lb.latencies.add(time.Since(r.start))
+			cancel := cancels[r.hedge]
+			r.resp.Body = &releaseBody{ReadCloser: r.resp.Body, release: func() { cancel(); lb.done(ctx, r.ep, false) }}
+			return r.resp, hedges, r.hedge > 0, nil
+		case <-ctx.Done():
+			abandon(-1)
+			return nil, hedges, false, ctx.Err()
+		}
+	}
+	return nil, hedges, false, lastErr
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyWindowPercentile(t *testing.T) {
+	ms := func(from, to int) []time.Duration {
+		var out []time.Duration
+		for i := from; i <= to; i++ {
+			out = append(out, time.Duration(i)*time.Millisecond)
+		}
+		return out
+	}
+	reversed := ms(1, 100)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		p       float64
+		want    time.Duration
+		wantOK  bool
+	}{
+		{name: "too few samples", samples: ms(1, minLatencySamples-1), p: 50},
+		{name: "just enough samples", samples: ms(1, minLatencySamples), p: 50, want: 10 * time.Millisecond, wantOK: true},
+		{name: "median", samples: ms(1, 100), p: 50, want: 50 * time.Millisecond, wantOK: true},
+		{name: "p95", samples: ms(1, 100), p: 95, want: 95 * time.Millisecond, wantOK: true},
+		{name: "fraction rounds up", samples: ms(1, 100), p: 99.9, want: 100 * time.Millisecond, wantOK: true},
+		{name: "tiny percentile is the fastest", samples: ms(1, 100), p: 0.1, want: time.Millisecond, wantOK: true},
+		{name: "order does not matter", samples: reversed, p: 95, want: 95 * time.Millisecond, wantOK: true},
+		// Only the latest latencySamples (128) count: 73..200ms.
+		{name: "window keeps the latest", samples: ms(1, 200), p: 50, want: 136 * time.Millisecond, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w latencyWindow
+			for _, d := range tt.samples {
+				w.add(d)
+			}
+			got, ok := w.percentile(tt.p)
+			if ok != tt.wantOK || got != tt.want {
+				t.Fatalf("percentile(%v) = %v, %v; want %v, %v", tt.p, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestHedgePolicyDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  HedgePolicy
+		samples int // latencies of 1..samples ms
+		want    time.Duration
+		wantOK  bool
+	}{
+		{name: "fixed delay", policy: HedgePolicy{Delay: "200ms"}, want: 200 * time.Millisecond, wantOK: true},
+		{name: "percentile without samples falls back to the delay", policy: HedgePolicy{Percentile: 90, Delay: "200ms"}, samples: 5, want: 200 * time.Millisecond, wantOK: true},
+		{name: "percentile without samples or delay", policy: HedgePolicy{Percentile: 90}, samples: 5},
+		{name: "percentile once there are samples", policy: HedgePolicy{Percentile: 90, Delay: "200ms"}, samples: 100, want: 90 * time.Millisecond, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newBalancer("svc", balanceRoundRobin, nil)
+			for i := 1; i <= tt.samples; i++ {
+				lb.latencies.add(time.Duration(i) * time.Millisecond)
+			}
+			got, ok := tt.policy.delay(lb)
+			if ok != tt.wantOK || got != tt.want {
+				t.Fatalf("delay = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name      string
+		percent   int           // PIPELINE_RETRY_BUDGET_PERCENT
+		minPerSec int           // PIPELINE_RETRY_BUDGET_MIN_PER_SEC; the cap is ten seconds of it, at least 10
+		balance   float64       // at the start; -1 = full, as newRetryBudget leaves it
+		idle      time.Duration // since the budget was last used
+		deposits  int
+		want      int // withdrawals that succeed
+	}{
+		{name: "starts full", percent: 20, balance: -1, want: 10},
+		{name: "empty", percent: 20},
+		{name: "calls earn their share", percent: 50, deposits: 4, want: 2},
+		{name: "fractions add up", percent: 20, balance: 0.5, deposits: 3, want: 1},
+		{name: "deposits are capped", percent: 100, deposits: 50, want: 10},
+		{name: "quiet service refills", percent: 20, minPerSec: 2, idle: 1500 * time.Millisecond, want: 3},
+		{name: "refill is capped", percent: 20, minPerSec: 2, idle: time.Hour, want: 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := clientConfig
+			clientConfig.RetryBudgetPercent, clientConfig.RetryBudgetMinPerSec = tt.percent, tt.minPerSec
+			t.Cleanup(func() { clientConfig = old })
+			b := newRetryBudget()
+			if tt.balance >= 0 {
+				b.balance = tt.balance
+			}
+			b.last = time.Now().Add(-tt.idle)
+			for i := 0; i < tt.deposits; i++ {
+				b.deposit()
+			}
+			got := 0
+			for got < 1000 && b.withdraw() {
+				got++
+			}
+			if got != tt.want {
+				t.Fatalf("%d withdrawals succeeded, want %d", got, tt.want)
+			}
+		})
+	}
+}
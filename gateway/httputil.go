@@ -1,22 +1,30 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"io"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ClientConfig holds retry and circuit breaker settings from env.
 type ClientConfig struct {
-	MaxRetries     int
-	BackoffBase    time.Duration
-	CircuitThreshold int
-	CircuitWindow  time.Duration
-	CircuitCooldown time.Duration
+	MaxRetries           int
+	BackoffBase          time.Duration
+	CircuitThreshold     int
+	CircuitWindow        time.Duration
+	CircuitCooldown      time.Duration
+	OutlierFailures      int           // consecutive failures that eject an endpoint (0 = never)
+	OutlierEjection      time.Duration // base ejection time, multiplied by the endpoint's ejection count
+	OutlierMaxPercent    int           // most endpoints of a service that may be ejected at once
+	RetryBudgetPercent   int           // retries + hedges allowed per 100 calls of a service
+	RetryBudgetMinPerSec int           // retries + hedges a service may always make per second
 }
 
 func loadClientConfig() ClientConfig {
@@ -47,11 +55,16 @@ func loadClientConfig() ClientConfig {
 		backoffMs = 100
 	}
 	return ClientConfig{
-		MaxRetries:        intEnv("PIPELINE_MAX_RETRIES", 3),
-		BackoffBase:       time.Duration(backoffMs) * time.Millisecond,
-		CircuitThreshold:  intEnv("PIPELINE_CIRCUIT_FAILURE_THRESHOLD", 5),
-		CircuitWindow:     durEnv("PIPELINE_CIRCUIT_WINDOW_SEC", 30*time.Second),
-		CircuitCooldown:   durEnv("PIPELINE_CIRCUIT_COOLDOWN_SEC", 30*time.Second),
+		MaxRetries:           intEnv("PIPELINE_MAX_RETRIES", 3),
+		BackoffBase:          time.Duration(backoffMs) * time.Millisecond,
+		CircuitThreshold:     intEnv("PIPELINE_CIRCUIT_FAILURE_THRESHOLD", 5),
+		CircuitWindow:        durEnv("PIPELINE_CIRCUIT_WINDOW_SEC", 30*time.Second),
+		CircuitCooldown:      durEnv("PIPELINE_CIRCUIT_COOLDOWN_SEC", 30*time.Second),
+		OutlierFailures:      intEnv("PIPELINE_OUTLIER_CONSECUTIVE_FAILURES", 5),
+		OutlierEjection:      durEnv("PIPELINE_OUTLIER_EJECTION_SEC", 30*time.Second),
+		OutlierMaxPercent:    intEnv("PIPELINE_OUTLIER_MAX_EJECTION_PERCENT", 50),
+		RetryBudgetPercent:   intEnv("PIPELINE_RETRY_BUDGET_PERCENT", 20),
+		RetryBudgetMinPerSec: intEnv("PIPELINE_RETRY_BUDGET_MIN_PER_SEC", 10),
 	}
 }
 
@@ -64,21 +77,35 @@ var (
 	)
 )
 
-// PostWithRetryAndCircuit performs a POST with trace context, retries on retryable errors with exponential backoff,
-// and uses the circuit breaker for the given key (e.g. service URL). Body must be a *bytes.Reader so it can be
-// reset between retries.
-func PostWithRetryAndCircuit(ctx context.Context, client *http.Client, url, contentType string, body *bytes.Reader, circuitKey string) (*http.Response, error) {
-	if !circuitBreaker.Allow(circuitKey) {
-		return nil, &circuitOpenError{}
+func init() {
+	circuitBreaker.onChange = func(ctx context.Context, key string, from, to circuitState) {
+		logger.WarnContext(ctx, "circuit state changed", "circuit", key, "from", from.String(), "to", to.String())
 	}
+}
+
+// PostWithRetryAndCircuit performs a POST of body to path on one of lb's endpoints with trace context, and retries
+// on retryable errors with exponential backoff. Each attempt picks an endpoint (a different one than before when
+// there is one), skipping endpoints whose circuit is open or that are ejected as outliers; key is the consistent
+// hash key (see balanceKey). With a hedge policy an attempt may also send hedged requests (see hedge.go).
+// Retries and hedges are paid from lb's retry budget; the hedges sent are recorded on the span in ctx.
+func PostWithRetryAndCircuit(ctx context.Context, client *http.Client, lb *balancer, path, contentType string, body []byte, key string, hedge *HedgePolicy) (*http.Response, error) {
 	var lastErr error
-	var resp *http.Response
 	backoff := clientConfig.BackoffBase
+	tried := make(map[string]bool)
+	hedges, hedgeWon := 0, false
+	defer func() {
+		if hedges > 0 {
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Int("step.hedges", hedges), attribute.Bool("step.hedge_won", hedgeWon))
+		}
+	}()
+	lb.budget.deposit()
 	for attempt := 0; attempt <= clientConfig.MaxRetries; attempt++ {
 		if attempt > 0 {
-			if body != nil {
-				_, _ = body.Seek(0, io.SeekStart)
+			if !lb.budget.withdraw() {
+				logger.WarnContext(ctx, "not retrying service call (retry budget exhausted)", "service", lb.service, "error", lastErr)
+				return nil, lastErr
 			}
+			logger.WarnContext(ctx, "retrying service call", "service", lb.service, "attempt", attempt, "backoff_ms", backoff.Milliseconds(), "error", lastErr)
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
@@ -89,24 +116,26 @@ func PostWithRetryAndCircuit(ctx context.Context, client *http.Client, url, cont
 				backoff = 5 * time.Second
 			}
 		}
-		resp, lastErr = postWithTrace(ctx, client, url, contentType, body)
-		if lastErr != nil {
-			// Retryable: network error
-			circuitBreaker.Failure(circuitKey)
-			continue
+		resp, n, won, err := sendAttempt(ctx, client, lb, path, contentType, body, key, tried, hedge)
+		hedges += n
+		hedgeWon = hedgeWon || won
+		if errors.Is(err, errNoEndpoint) {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			if len(lb.urls()) == 0 {
+				return nil, fmt.Errorf("no endpoints for %s (service discovery returned none)", lb.service)
+			}
+			logger.WarnContext(ctx, "service call rejected (circuit open)", "service", lb.service)
+			return nil, &circuitOpenError{}
 		}
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			circuitBreaker.Success(circuitKey)
+		if err == nil {
 			return resp, nil
 		}
-		if resp.StatusCode == 429 || (resp.StatusCode >= 500 && resp.StatusCode < 600) {
-			_ = resp.Body.Close()
-			circuitBreaker.Failure(circuitKey)
-			lastErr = &httpStatusError{status: resp.StatusCode}
-			continue
+		if ctx.Err() != nil {
+			return nil, err
 		}
-		circuitBreaker.Success(circuitKey)
-		return resp, nil
+		lastErr = err
 	}
 	return nil, lastErr
 }
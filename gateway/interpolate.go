@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// referenceRe matches ${NAME}, ${NAME:-default} and ${file:/path}. "$${" is a literal "${".
+var referenceRe = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// interpolate replaces references in s with environment variables or file contents (trailing newline trimmed).
+// An unset variable without a default, or an unreadable file, is an error.
+func interpolate(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var firstErr error
+	out := referenceRe.ReplaceAllStringFunc(s, func(m string) string {
+		if strings.HasPrefix(m, "$$") {
+			return m[1:]
+		}
+		expr := m[2 : len(m)-1]
+		if path, ok := strings.CutPrefix(expr, "file:"); ok {
+			data, err := os.ReadFile(strings.TrimSpace(path))
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("${%s}: %w", expr, err)
+				}
+				return ""
+			}
+			return strings.TrimRight(string(data), "\r\n")
+		}
+		name, def, hasDef := strings.Cut(expr, ":-")
+		name = strings.TrimSpace(name)
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		if hasDef {
+			return def
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("${%s}: environment variable not set", name)
+		}
+		return ""
+	})
+	return out, firstErr
+}
+
+// hasReference reports whether s contains a ${...} reference.
+func hasReference(s string) bool {
+	return strings.Contains(s, "${")
+}
+
+// referenceFields returns the string values of s that contain references, by JSON path ("url",
+// "variants.0.url", ...).
+func referenceFields(s PipelineService) map[string]string {
+	out := map[string]string{}
+	data, _ := json.Marshal(s)
+	var m interface{}
+	_ = json.Unmarshal(data, &m)
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		switch t := v.(type) {
+		case string:
+			if hasReference(t) {
+				out[path] = t
+			}
+		case map[string]interface{}:
+			for k, e := range t {
+				walk(strings.TrimPrefix(path+"."+k, "."), e)
+			}
+		case []interface{}:
+			for i, e := range t {
+				walk(fmt.Sprintf("%s.%d", path, i), e)
+			}
+		}
+	}
+	walk("", m)
+	return out
+}
+
+// newReferences returns the fields of s (sorted) whose references no service of existing has in the same
+// field. References expose the gateway's environment and files to whoever can read what they resolve to,
+// so only the config file or store may add them; API writes may keep them but not add or move them.
+func newReferences(s PipelineService, existing []PipelineService) []string {
+	var out []string
+	for path, v := range referenceFields(s) {
+		found := false
+		for _, e := range existing {
+			if referenceFields(e)[path] == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, path)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// checkNoNewReferences returns an error naming the first service of services that adds references
+// (see newReferences) to existing.
+func checkNoNewReferences(services, existing []PipelineService) error {
+	for _, s := range services {
+		if fields := newReferences(s, existing); len(fields) > 0 {
+			return fmt.Errorf("%s: ${...} references can only be added in the config file (%s)", s.Name, strings.Join(fields, ", "))
+		}
+	}
+	return nil
+}
+
+// resolveService interpolates every string value of s (including nested ones) and normalizes the
+// resolved URL. The stored config keeps the references; only calls to services use the result.
+func resolveService(s PipelineService) (PipelineService, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return s, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return s, err
+	}
+	changed := false
+	var walk func(v interface{}) (interface{}, error)
+	walk = func(v interface{}) (interface{}, error) {
+		switch t := v.(type) {
+		case string:
+			if !hasReference(t) {
+				return t, nil
+			}
+			changed = true
+			return interpolate(t)
+		case map[string]interface{}:
+			for k, e := range t {
+				r, err := walk(e)
+				if err != nil {
+					return nil, err
+				}
+				t[k] = r
+			}
+		case []interface{}:
+			for i, e := range t {
+				r, err := walk(e)
+				if err != nil {
+					return nil, err
+				}
+				t[i] = r
+			}
+		}
+		return v, nil
+	}
+	if _, err := walk(m); err != nil {
+		return s, err
+	}
+	if !changed {
+		return s, nil
+	}
+	data, err = json.Marshal(m)
+	if err != nil {
+		return s, err
+	}
+	var out PipelineService
+	if err := json.Unmarshal(data, &out); err != nil {
+		return s, err
+	}
+	out.URL = NormalizeURL(out.URL)
+	out.Endpoints = normalizeURLs(out.Endpoints)
+	out.Variants = normalizeVariants(out.Variants)
+	out.Shadow = NormalizeURL(out.Shadow)
+	out.Compensate = NormalizeURL(out.Compensate)
+	if out.Fallback != nil {
+		out.Fallback.URL = NormalizeURL(out.Fallback.URL)
+	}
+	return out, nil
+}
+
+// resolve fills ps.resolved with the interpolated services of every pipeline, with pipeline and include
+// entries expanded (see compose.go).
+func (ps *pipelineSet) resolve() error {
+	resolved := make(map[string][]PipelineService, len(ps.Pipelines))
+	for _, name := range ps.names() {
+		e := &expander{ps: ps, stack: []string{name}}
+		out, err := e.expand(ps.Pipelines[name], includeDir(), nil)
+		if err != nil {
+			return fmt.Errorf("pipeline %s: %w", name, err)
+		}
+		resolved[name] = out
+	}
+	ps.resolved = resolved
+	return nil
+}
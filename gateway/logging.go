@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logger is the gateway's structured logger. initLogging replaces it at startup.
+var logger = slog.New(newTraceContextHandler(slog.NewTextHandler(os.Stderr, nil)))
+
+func parseLogLevel(s string) slog.Level {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// initLogging configures logger from LOG_LEVEL (debug|info|warn|error) and LOG_FORMAT (json|text).
+// When OTEL_LOGS_EXPORTER=otlp, records are also exported over OTLP/HTTP to OTEL_EXPORTER_OTLP_ENDPOINT.
+func initLogging(ctx context.Context) (func(), error) {
+	level := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	opts := &slog.HandlerOptions{Level: level}
+	var base slog.Handler
+	if strings.ToLower(os.Getenv("LOG_FORMAT")) == "json" {
+		base = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		base = slog.NewTextHandler(os.Stderr, opts)
+	}
+	handler := slog.Handler(newTraceContextHandler(base))
+	shutdown := func() {}
+
+	var err error
+	if strings.ToLower(os.Getenv("OTEL_LOGS_EXPORTER")) == "otlp" {
+		var exporter *otlploghttp.Exporter
+		exporter, err = otlploghttp.New(ctx,
+			otlploghttp.WithEndpoint(otlpEndpoint()),
+			otlploghttp.WithInsecure(),
+		)
+		if err == nil {
+			provider := sdklog.NewLoggerProvider(
+				sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)),
+				sdklog.WithResource(serviceResource()),
+			)
+			handler = &fanoutHandler{
+				level:    level,
+				handlers: []slog.Handler{handler, otelslog.NewHandler("gateway", otelslog.WithLoggerProvider(provider))},
+			}
+			shutdown = func() {
+				_ = provider.Shutdown(ctx)
+			}
+		}
+	}
+
+	logger = slog.New(handler)
+	slog.SetDefault(logger)
+	return shutdown, err
+}
+
+// traceContextHandler adds trace_id and span_id from the record's context so log lines can be joined with traces.
+type traceContextHandler struct {
+	slog.Handler
+}
+
+func newTraceContextHandler(h slog.Handler) *traceContextHandler {
+	return &traceContextHandler{Handler: h}
+}
+
+func (h *traceContextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *traceContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &traceContextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *traceContextHandler) WithGroup(name string) slog.Handler {
+	return &traceContextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// fanoutHandler sends each record at or above level to every handler.
+type fanoutHandler struct {
+	level    slog.Leveler
+	handlers []slog.Handler
+}
+
+func (h *fanoutHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, hh := range h.handlers {
+		if hh.Enabled(ctx, r.Level) {
+			errs = append(errs, hh.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := &fanoutHandler{level: h.level, handlers: make([]slog.Handler, len(h.handlers))}
+	for i, hh := range h.handlers {
+		out.handlers[i] = hh.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (h *fanoutHandler) WithGroup(name string) slog.Handler {
+	out := &fanoutHandler{level: h.level, handlers: make([]slog.Handler, len(h.handlers))}
+	for i, hh := range h.handlers {
+		out.handlers[i] = hh.WithGroup(name)
+	}
+	return out
+}
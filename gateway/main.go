@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"os"
 
@@ -11,12 +10,38 @@ import (
 
 func main() {
 	ctx := context.Background()
+	shutdownLogs, err := initLogging(ctx)
+	if err != nil {
+		logger.Warn("OTLP log export init failed (continuing without)", "error", err)
+	}
+	defer shutdownLogs()
 	shutdown, err := initTracing(ctx)
 	if err != nil {
-		log.Printf("Tracing init failed (continuing without): %v", err)
+		logger.Warn("Tracing init failed (continuing without)", "error", err)
 	} else {
 		defer shutdown()
 	}
+	shutdownMetrics, err := initMetrics(ctx)
+	if err != nil {
+		logger.Warn("Metrics init failed (continuing without)", "error", err)
+	} else {
+		defer shutdownMetrics()
+	}
+
+	if err := initConfigStore(); err != nil {
+		logger.Error("Pipeline config store init failed", "error", err)
+		os.Exit(1)
+	}
+	if err := checkPipelineSource(); err != nil {
+		logger.Error("Refusing to start", "error", err)
+		os.Exit(1)
+	}
+
+	stopWatch, err := startConfigWatcher(ctx)
+	if err != nil {
+		logger.Warn("Pipeline config watch failed (continuing without hot reload)", "error", err)
+	}
+	defer stopWatch()
 
 	staticDir := os.Getenv("STATIC_DIR")
 	// When empty: use embedded Vue app (Docker build). Set STATIC_DIR e.g. to ../frontend/dist for local dev.
@@ -29,6 +54,7 @@ func main() {
 	r.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag")
 			next.ServeHTTP(w, req)
 		})
 	})
@@ -39,8 +65,9 @@ func main() {
 	if staticDir != "" {
 		staticSource = staticDir
 	}
-	log.Printf("TraceMS gateway listening on %s (static: %s)", addr, staticSource)
+	logger.Info("TraceMS gateway listening", "addr", addr, "static", staticSource)
 	if err := http.ListenAndServe(addr, r); err != nil {
-		log.Fatal(err)
+		logger.Error("Server stopped", "error", err)
+		os.Exit(1)
 	}
 }
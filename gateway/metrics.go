@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/exemplar"
+)
+
+// gatewayMetrics holds the gateway's OTel instruments. Instruments are created on the global meter,
+// so they start exporting once initMetrics installs the SDK meter provider.
+type gatewayMetrics struct {
+	runDuration  metric.Float64Histogram
+	stepDuration metric.Float64Histogram
+	retries      metric.Int64Counter
+	payloadSize  metric.Int64Histogram
+	shadows      metric.Int64Counter
+	hedges       metric.Int64Counter
+}
+
+func newGatewayMetrics(meter metric.Meter) *gatewayMetrics {
+	m := &gatewayMetrics{}
+	m.runDuration, _ = meter.Float64Histogram("tracems.pipeline.run.duration",
+		metric.WithDescription("Duration of a full pipeline run"),
+		metric.WithUnit("s"),
+	)
+	m.stepDuration, _ = meter.Float64Histogram("tracems.pipeline.step.duration",
+		metric.WithDescription("Duration of one pipeline step, including retries"),
+		metric.WithUnit("s"),
+	)
+	m.retries, _ = meter.Int64Counter("tracems.pipeline.retries",
+		metric.WithDescription("Retried calls to pipeline services"),
+		metric.WithUnit("{retry}"),
+	)
+	m.payloadSize, _ = meter.Int64Histogram("tracems.pipeline.payload.size",
+		metric.WithDescription("Size of request bodies sent to pipeline services"),
+		metric.WithUnit("By"),
+	)
+	m.shadows, _ = meter.Int64Counter("tracems.pipeline.shadow.comparisons",
+		metric.WithDescription("Shadow calls by outcome (match, mismatch, error, skipped)"),
+		metric.WithUnit("{call}"),
+	)
+	m.hedges, _ = meter.Int64Counter("tracems.pipeline.hedges",
+		metric.WithDescription("Hedged requests sent to pipeline services"),
+		metric.WithUnit("{request}"),
+	)
+	_, _ = meter.Int64ObservableGauge("tracems.circuit.state",
+		metric.WithDescription("Circuit breaker state per service (0 closed, 1 open, 2 half-open)"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			for key, state := range circuitBreaker.States() {
+				o.Observe(int64(state), metric.WithAttributes(attribute.String("circuit", key)))
+			}
+			return nil
+		}),
+	)
+	return m
+}
+
+var pipelineMetrics = newGatewayMetrics(otel.Meter("gateway"))
+
+// RecordRun records the duration of a pipeline run. endpoint is the process endpoint (stream, json, form).
+func (m *gatewayMetrics) RecordRun(ctx context.Context, endpoint, status string, start time.Time) {
+	m.runDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		attribute.String("endpoint", endpoint),
+		attribute.String("status", status),
+	))
+}
+
+// RecordStep records the duration of one pipeline step.
+func (m *gatewayMetrics) RecordStep(ctx context.Context, service, status string, start time.Time) {
+	m.stepDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		attribute.String("service", service),
+		attribute.String("status", status),
+	))
+}
+
+// RecordRetry counts one retried call to url.
+func (m *gatewayMetrics) RecordRetry(ctx context.Context, url string) {
+	m.retries.Add(ctx, 1, metric.WithAttributes(attribute.String("url", url)))
+}
+
+// RecordPayload records the size of the body sent to service.
+func (m *gatewayMetrics) RecordPayload(ctx context.Context, service string, size int) {
+	m.payloadSize.Record(ctx, int64(size), metric.WithAttributes(attribute.String("service", service)))
+}
+
+// RecordHedge counts one hedged request to service.
+func (m *gatewayMetrics) RecordHedge(ctx context.Context, service string) {
+	m.hedges.Add(ctx, 1, metric.WithAttributes(attribute.String("service", service)))
+}
+
+// RecordShadow counts one shadow call of service with its comparison result.
+func (m *gatewayMetrics) RecordShadow(ctx context.Context, service, result string) {
+	m.shadows.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("service", service),
+		attribute.String("result", result),
+	))
+}
+
+// initMetrics installs a meter provider exporting over OTLP/HTTP to the same endpoint as traces.
+// Measurements recorded inside a sampled span carry exemplars with its trace and span IDs.
+func initMetrics(ctx context.Context) (func(), error) {
+	exporter, err := otlpmetrichttp.New(ctx,
+		otlpmetrichttp.WithEndpoint(otlpEndpoint()),
+		otlpmetrichttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(serviceResource()),
+		sdkmetric.WithExemplarFilter(exemplar.TraceBasedFilter),
+	)
+	otel.SetMeterProvider(provider)
+
+	shutdown := func() {
+		_ = provider.Shutdown(ctx)
+	}
+	return shutdown, nil
+}
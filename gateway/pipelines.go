@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var pipelineNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// validPipelineName reports whether name can be used in /process/{pipeline} URLs.
+// "stream" and "json" are reserved by /process/stream and /process/json.
+func validPipelineName(name string) bool {
+	return pipelineNameRe.MatchString(name) && name != "stream" && name != "json"
+}
+
+func apiPipelinesList(w http.ResponseWriter, r *http.Request) {
+	ps := loadPipelineSet()
+	type pipelineOut struct {
+		Name     string `json:"name"`
+		Default  bool   `json:"default"`
+		Services int    `json:"services"`
+	}
+	out := []pipelineOut{}
+	for _, name := range ps.names() {
+		out = append(out, pipelineOut{Name: name, Default: name == ps.Default, Services: len(ps.Pipelines[name])})
+	}
+	replyJSON(w, map[string]interface{}{"default": ps.Default, "pipelines": out})
+}
+
+func apiPipelineNamedGet(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	ps := loadPipelineSet()
+	svc, ok := ps.Pipelines[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"detail": "Pipeline not found: " + name})
+		return
+	}
+	w.Header().Set("ETag", pipelineETag(ps))
+	replyJSON(w, map[string]interface{}{
+		"name":     name,
+		"default":  name == ps.Default,
+		"services": pipelineServicesOut(svc),
+	})
+}
+
+func apiPipelineNamedPut(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if !validPipelineName(name) {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Invalid pipeline name: " + name})
+		return
+	}
+	if !requireIfMatch(w, r) {
+		return
+	}
+	var body PipelineUpdate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Invalid JSON"})
+		return
+	}
+	svc, detail := servicesFromUpdate(body)
+	if detail != "" {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": detail})
+		return
+	}
+	if !validateForWrite(w, r, name, svc) {
+		return
+	}
+	res, err := SetNamedPipeline(name, svc, changeMetaFromRequest(r))
+	if replyPreconditionFailed(w, err) || replyInvalidPipeline(w, err) {
+		return
+	}
+	if err != nil {
+		replyJSON(w, map[string]interface{}{"ok": true, "saved": false, "detail": err.Error()})
+		return
+	}
+	w.Header().Set("ETag", res.ETag)
+	saved := storeAuthoritative()
+	replyJSON(w, map[string]interface{}{"ok": true, "saved": saved, "version": res.Version})
+}
+
+func apiPipelineNamedDelete(w http.ResponseWriter, r *http.Request) {
+	if !requireIfMatch(w, r) {
+		return
+	}
+	name := chi.URLParam(r, "name")
+	res, err := DeletePipeline(name, changeMetaFromRequest(r))
+	if replyPreconditionFailed(w, err) {
+		return
+	}
+	if errors.Is(err, errPipelineNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Pipeline not found: " + name})
+		return
+	}
+	if err != nil {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": err.Error()})
+		return
+	}
+	w.Header().Set("ETag", res.ETag)
+	replyJSON(w, map[string]interface{}{"ok": true, "saved": storeAuthoritative(), "version": res.Version})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Services announce themselves with POST /api/registry and renew before their TTL runs out; a pipeline entry
+// with url (or an endpoint) registry:<name> is balanced over the live instances registered under that name.
+// The registry is kept in memory, so with several gateway replicas each service registers with every replica.
+
+// RegistryRegistration is POST /api/registry body.
+type RegistryRegistration struct {
+	Name         string   `json:"name"`
+	URL          string   `json:"url"`
+	Capabilities []string `json:"capabilities"`
+	InputType    string   `json:"input_type"`
+	OutputType   string   `json:"output_type"`
+	TTL          int      `json:"ttl"` // seconds; REGISTRY_DEFAULT_TTL when 0
+}
+
+// RegistryHeartbeat is the optional POST /api/registry/{id}/heartbeat body.
+type RegistryHeartbeat struct {
+	TTL int `json:"ttl"`
+}
+
+// registryInstance is one registered service instance.
+type registryInstance struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	URL           string    `json:"url"`
+	Capabilities  []string  `json:"capabilities"`
+	InputType     string    `json:"input_type"`
+	OutputType    string    `json:"output_type"`
+	TTL           int       `json:"ttl"`
+	RegisteredAt  time.Time `json:"registered_at"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+type serviceRegistry struct {
+	mu   sync.Mutex
+	byID map[string]*registryInstance
+	now  func() time.Time
+
+	// view is the live URLs by name that balancers read on every pick, nil when instances were added or
+	// removed since it was built; it is also rebuilt after viewUntil, the first expiry it includes.
+	view      map[string][]string
+	viewUntil time.Time
+}
+
+var registry = &serviceRegistry{byID: make(map[string]*registryInstance), now: time.Now}
+
+func registryTTLEnv(key string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// clampTTL applies REGISTRY_DEFAULT_TTL (default 30) to 0 and caps at REGISTRY_MAX_TTL (default 3600) seconds.
+func clampTTL(ttl int) int {
+	if ttl <= 0 {
+		return registryTTLEnv("REGISTRY_DEFAULT_TTL", 30)
+	}
+	if max := registryTTLEnv("REGISTRY_MAX_TTL", 3600); ttl > max {
+		return max
+	}
+	return ttl
+}
+
+// registrationID is stable for a name and URL, so a service that re-registers after a restart (or after
+// its registration expired) keeps its id.
+func registrationID(name, url string) string {
+	sum := sha256.Sum256([]byte(name + "\n" + url))
+	return hex.EncodeToString(sum[:8])
+}
+
+// pruneLocked drops expired instances. Caller must hold reg.mu.
+func (reg *serviceRegistry) pruneLocked(now time.Time) {
+	for id, inst := range reg.byID {
+		if now.After(inst.ExpiresAt) {
+			delete(reg.byID, id)
+			reg.view = nil
+			logger.Warn("service registration expired", "service", inst.Name, "url", inst.URL, "id", id)
+		}
+	}
+}
+
+// register adds or renews an instance.
+func (reg *serviceRegistry) register(r RegistryRegistration) registryInstance {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	now := reg.now().UTC()
+	reg.pruneLocked(now)
+	id := registrationID(r.Name, r.URL)
+	inst, ok := reg.byID[id]
+	if !ok {
+		inst = &registryInstance{ID: id, Name: r.Name, URL: r.URL, RegisteredAt: now}
+		reg.byID[id] = inst
+		reg.view = nil
+		logger.Info("service registered", "service", r.Name, "url", r.URL, "id", id)
+	}
+	inst.Capabilities = r.Capabilities
+	if inst.Capabilities == nil {
+		inst.Capabilities = []string{}
+	}
+	inst.InputType, inst.OutputType = r.InputType, r.OutputType
+	inst.TTL = clampTTL(r.TTL)
+	inst.LastHeartbeat = now
+	inst.ExpiresAt = now.Add(time.Duration(inst.TTL) * time.Second)
+	return *inst
+}
+
+// heartbeat renews the instance with id, optionally with a new TTL. ok is false if it is unknown or expired.
+func (reg *serviceRegistry) heartbeat(id string, ttl int) (registryInstance, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	now := reg.now().UTC()
+	reg.pruneLocked(now)
+	inst, ok := reg.byID[id]
+	if !ok {
+		return registryInstance{}, false
+	}
+	if ttl > 0 {
+		inst.TTL = clampTTL(ttl)
+	}
+	inst.LastHeartbeat = now
+	inst.ExpiresAt = now.Add(time.Duration(inst.TTL) * time.Second)
+	if inst.ExpiresAt.Before(reg.viewUntil) {
+		reg.viewUntil = inst.ExpiresAt // a shorter TTL
+	}
+	return *inst, true
+}
+
+func (reg *serviceRegistry) deregister(id string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	inst, ok := reg.byID[id]
+	if ok {
+		delete(reg.byID, id)
+		reg.view = nil
+		logger.Info("service deregistered", "service", inst.Name, "url", inst.URL, "id", id)
+	}
+	return ok
+}
+
+// instances returns the live instances sorted by name, then URL.
+func (reg *serviceRegistry) instances() []registryInstance {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.pruneLocked(reg.now().UTC())
+	out := make([]registryInstance, 0, len(reg.byID))
+	for _, inst := range reg.byID {
+		out = append(out, *inst)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].URL < out[j].URL
+	})
+	return out
+}
+
+// urls returns the base URLs of the live instances registered as name, sorted. The result is shared;
+// callers must not modify it.
+func (reg *serviceRegistry) urls(name string) []string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	now := reg.now().UTC()
+	if reg.view == nil || now.After(reg.viewUntil) {
+		reg.pruneLocked(now)
+		reg.view = make(map[string][]string)
+		reg.viewUntil = now.Add(24 * time.Hour)
+		for _, inst := range reg.byID {
+			reg.view[inst.Name] = append(reg.view[inst.Name], inst.URL)
+			if inst.ExpiresAt.Before(reg.viewUntil) {
+				reg.viewUntil = inst.ExpiresAt
+			}
+		}
+		for _, list := range reg.view {
+			sort.Strings(list)
+		}
+	}
+	return reg.view[name]
+}
+
+// registryName returns the service name of a registry:<name> (or registry://<name>) URL.
+func registryName(u string) (string, bool) {
+	rest, ok := strings.CutPrefix(u, "registry:")
+	if !ok {
+		return "", false
+	}
+	return strings.Trim(rest, "/"), true
+}
+
+func apiRegistryRegister(w http.ResponseWriter, r *http.Request) {
+	var body RegistryRegistration
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Invalid JSON"})
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	body.URL = strings.TrimRight(NormalizeURL(body.URL), "/")
+	if body.Name == "" {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "name is required"})
+		return
+	}
+	if _, msg := checkServiceURL(body.URL); msg != "" {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": msg})
+		return
+	}
+	inst := registry.register(body)
+	replyJSON(w, map[string]interface{}{"ok": true, "id": inst.ID, "ttl": inst.TTL, "expires_at": inst.ExpiresAt})
+}
+
+func apiRegistryHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var body RegistryHeartbeat
+	_ = json.NewDecoder(r.Body).Decode(&body) // the body is optional
+	inst, ok := registry.heartbeat(chi.URLParam(r, "id"), body.TTL)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Registration not found or expired; register again"})
+		return
+	}
+	replyJSON(w, map[string]interface{}{"ok": true, "id": inst.ID, "ttl": inst.TTL, "expires_at": inst.ExpiresAt})
+}
+
+func apiRegistryDelete(w http.ResponseWriter, r *http.Request) {
+	if !registry.deregister(chi.URLParam(r, "id")) {
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Registration not found"})
+		return
+	}
+	replyJSON(w, map[string]interface{}{"ok": true})
+}
+
+// apiRegistryList returns the catalog: every registered name with its live instances.
+func apiRegistryList(w http.ResponseWriter, r *http.Request) {
+	type entry struct {
+		Name      string             `json:"name"`
+		Instances []registryInstance `json:"instances"`
+	}
+	services := []entry{}
+	for _, inst := range registry.instances() {
+		if n := len(services); n == 0 || services[n-1].Name != inst.Name {
+			services = append(services, entry{Name: inst.Name})
+		}
+		last := &services[len(services)-1]
+		last.Instances = append(last.Instances, inst)
+	}
+	replyJSON(w, map[string]interface{}{"services": services})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// What a run does when a service fails (after its retries and fallback), set per service with on_error.
+const (
+	onErrorAbort      = "abort"       // stop the run (default), compensating the completed steps (see compensate.go)
+	onErrorSkip       = "skip"        // continue with the payload the service got, as if it was not there
+	onErrorContinue   = "continue"    // like skip, and record the error in payload metadata.pipeline_errors
+	onErrorDeadLetter = "dead_letter" // stop the run and keep it in the dead-letter store (see deadletter.go)
+)
+
+func validOnError(s string) bool {
+	switch s {
+	case "", onErrorAbort, onErrorSkip, onErrorContinue, onErrorDeadLetter:
+		return true
+	}
+	return false
+}
+
+// Step outcomes, as listed in a run's outcomes.
+const (
+	outcomeOK         = "ok"
+	outcomeFallback   = "fallback"
+	outcomeSkipped    = "skipped"
+	outcomeContinued  = "continued"
+	outcomeFailed     = "failed"      // the step that aborted the run
+	outcomeDeadLetter = "dead_letter" // the step that aborted the run, which was dead-lettered
+	outcomeNotRun     = "not_run"     // after the run was aborted
+)
+
+// stepOutcome is how one service of a run ended.
+type stepOutcome struct {
+	Service      string  `json:"service"`
+	Pipeline     string  `json:"pipeline,omitempty"` // sub-pipeline path (see compose.go)
+	Status       string  `json:"status"`
+	Variant      string  `json:"variant,omitempty"`
+	Error        string  `json:"error,omitempty"`
+	DurationMs   float64 `json:"duration_ms"`
+	Compensation string  `json:"compensation,omitempty"` // compensated or failed, after the run was aborted
+}
+
+// Run statuses: every step ok; completed with fallbacks, skipped or continued steps; aborted; aborted and
+// dead-lettered.
+const (
+	runOK         = "ok"
+	runDegraded   = "degraded"
+	runError      = "error"
+	runDeadLetter = "dead_letter"
+)
+
+// runResult is the end state of a run.
+type runResult struct {
+	payload  map[string]interface{}
+	steps    []interface{}
+	outcomes []stepOutcome
+	status   string
+	failed   *stepOutcome // the step that aborted the run, nil if it completed
+	failedAt int          // index of the failed step in the services run
+
+	done         []completedStep // completed steps to compensate if the run is aborted
+	deadLetterID string          // set by deadLetterRun
+}
+
+// stepHook is called after each step that did not abort the run; processStream sends SSE events from it.
+type stepHook func(svc PipelineService, call stepCall, outcome stepOutcome)
+
+// runPipeline calls services in order starting from payload and the steps of earlier services (nil for a
+// new run), applying each service's on_error policy when it fails. onStep may be nil.
+func runPipeline(ctx context.Context, services []PipelineService, payload map[string]interface{}, steps []interface{}, onStep stepHook) runResult {
+	return continueRun(ctx, services, runResult{payload: payload, steps: steps}, onStep)
+}
+
+// continueRun calls services after the part of a run in res: its payload, steps, outcomes and the completed
+// steps to compensate (see deadletter.go). onStep may be nil.
+func continueRun(ctx context.Context, services []PipelineService, res runResult, onStep stepHook) runResult {
+	if res.steps == nil {
+		res.steps = []interface{}{}
+	}
+	res.outcomes = append(make([]stepOutcome, 0, len(res.outcomes)+len(services)), res.outcomes...)
+	res.done = res.done[:len(res.done):len(res.done)]
+	res.status = runOK
+	for _, out := range res.outcomes {
+		if out.Status != outcomeOK {
+			res.status = runDegraded
+		}
+	}
+	client := &http.Client{Timeout: 120 * time.Second}
+	spans := newSubPipelineSpans(ctx)
+	defer spans.end()
+	for i, svc := range services {
+		start := time.Now()
+		call := callService(spans.enter(svc), client, svc, res.payload, res.steps)
+		out := stepOutcome{Service: svc.Name, Pipeline: viaPath(svc.via), Status: outcomeOK, Variant: call.variant}
+		out.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+		switch {
+		case call.err == nil:
+			res.payload, res.steps = call.payload, call.steps
+			if call.fallback != "" {
+				out.Status, out.Error = outcomeFallback, getStr(call.last, "error", "")
+			} else if svc.Compensate != "" {
+				res.done = append(res.done, completedStep{svc: svc, outcome: len(res.outcomes), payload: call.payload})
+			}
+		case svc.OnError == onErrorSkip || svc.OnError == onErrorContinue:
+			in := res.payload
+			out.Status, out.Error = outcomeSkipped, call.detail
+			if svc.OnError == onErrorContinue {
+				out.Status = outcomeContinued
+				res.payload = withPipelineError(res.payload, svc.Name, call.detail)
+			}
+			call.last = map[string]interface{}{
+				"service": svc.Name,
+				"status":  out.Status,
+				"error":   call.detail,
+				"input":   previewPayload(in),
+				"output":  previewPayload(res.payload),
+			}
+			res.steps = append(res.steps[:len(res.steps):len(res.steps)], call.last)
+			call.last = tagStep(res.steps, svc)
+			call.payload, call.steps = res.payload, res.steps
+		default:
+			out.Status, out.Error = outcomeFailed, call.detail
+			res.status = runError
+			if svc.OnError == onErrorDeadLetter {
+				out.Status, res.status = outcomeDeadLetter, runDeadLetter
+			}
+			res.outcomes = append(res.outcomes, out)
+			res.failed, res.failedAt = &res.outcomes[len(res.outcomes)-1], i
+			for _, rest := range services[i+1:] {
+				res.outcomes = append(res.outcomes, stepOutcome{Service: rest.Name, Pipeline: viaPath(rest.via), Status: outcomeNotRun})
+			}
+			spans.end()
+			if res.status == runError && len(res.done) > 0 {
+				compensate(ctx, client, res.done, &res)
+			}
+			return res
+		}
+		if out.Status != outcomeOK {
+			res.status = runDegraded
+		}
+		res.outcomes = append(res.outcomes, out)
+		if onStep != nil {
+			onStep(svc, call, out)
+		}
+	}
+	return res
+}
+
+// withPipelineError returns a copy of payload with {service, error} appended to metadata.pipeline_errors.
+func withPipelineError(payload map[string]interface{}, service, msg string) map[string]interface{} {
+	out := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		out[k] = v
+	}
+	meta := map[string]interface{}{}
+	if m, ok := payload["metadata"].(map[string]interface{}); ok {
+		for k, v := range m {
+			meta[k] = v
+		}
+	}
+	errs, _ := meta["pipeline_errors"].([]interface{})
+	meta["pipeline_errors"] = append(errs[:len(errs):len(errs)], map[string]interface{}{"service": service, "error": msg})
+	out["metadata"] = meta
+	return out
+}
+
+// runResponse is the reply of the process endpoints (the "done" event for /process/stream).
+func runResponse(traceID string, rp resolvedPipeline, res runResult) map[string]interface{} {
+	out := map[string]interface{}{
+		"trace_id":         traceID,
+		"trace_url":        traceURL(traceID),
+		"pipeline":         rp.Name,
+		"pipeline_version": rp.Version,
+		"status":           res.status,
+		"result":           res.payload["data"],
+		"stored":           res.failed == nil,
+		"steps":            res.steps,
+		"payload":          res.payload,
+		"outcomes":         res.outcomes,
+	}
+	if res.failed != nil {
+		out["failed_service"] = res.failed.Service
+		out["error"] = res.failed.Error
+	}
+	if res.deadLetterID != "" {
+		out["dead_letter_id"] = res.deadLetterID
+	}
+	return out
+}
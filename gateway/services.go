@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var errServiceNotFound = errors.New("service not found")
+
+// serviceValidationError carries a validation detail from inside UpdateNamedPipeline back to the handler.
+type serviceValidationError struct {
+	detail      string
+	diagnostics []Diagnostic
+}
+
+func (e *serviceValidationError) Error() string {
+	return e.detail
+}
+
+// ServiceAdd is POST /api/pipeline/services body: one service plus an optional position (default: append).
+type ServiceAdd struct {
+	PipelineServiceUpdate
+	Position *int `json:"position"`
+}
+
+// ServicePatch is PATCH /api/pipeline/services/{name} body. Omitted fields are left unchanged.
+type ServicePatch struct {
+	Name        *string           `json:"name"`
+	URL         *string           `json:"url"`
+	Icon        *string           `json:"icon"`
+	Description *string           `json:"description"`
+	InputType   *string           `json:"input_type"`
+	OutputType  *string           `json:"output_type"`
+	Pipeline    *string           `json:"pipeline"`
+	Include     *string           `json:"include"`
+	Endpoints   *[]string         `json:"endpoints"`
+	Balance     *string           `json:"balance"`
+	HashKey     *string           `json:"hash_key"`
+	Variants    *[]ServiceVariant `json:"variants"`
+	StickyKey   *string           `json:"sticky_key"`
+	Shadow      *string           `json:"shadow"`
+	Hedge       *HedgePolicy      `json:"hedge"`    // {} removes the policy
+	Fallback    *ServiceFallback  `json:"fallback"` // {} removes the fallback
+	OnError     *string           `json:"on_error"`
+	Compensate  *string           `json:"compensate"`
+}
+
+// ServiceMove is POST /api/pipeline/services/{name}/move body. Exactly one of the fields should be set.
+type ServiceMove struct {
+	Position *int    `json:"position"`
+	Before   *string `json:"before"`
+	After    *string `json:"after"`
+}
+
+func serviceIndex(svc []PipelineService, name string) int {
+	for i := range svc {
+		if svc[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// clampPosition limits pos to [0, n].
+func clampPosition(pos, n int) int {
+	if pos < 0 {
+		return 0
+	}
+	if pos > n {
+		return n
+	}
+	return pos
+}
+
+func insertService(svc []PipelineService, pos int, s PipelineService) []PipelineService {
+	pos = clampPosition(pos, len(svc))
+	out := make([]PipelineService, 0, len(svc)+1)
+	out = append(out, svc[:pos]...)
+	out = append(out, s)
+	return append(out, svc[pos:]...)
+}
+
+func removeService(svc []PipelineService, i int) []PipelineService {
+	out := make([]PipelineService, 0, len(svc)-1)
+	out = append(out, svc[:i]...)
+	return append(out, svc[i+1:]...)
+}
+
+// applyServiceChange runs fn on the pipeline from the URL ({name} param, default pipeline otherwise),
+// validates the result like PUT /api/pipeline and writes the reply; ?validate=false skips the validation.
+// Network checks take too long to hold the config lock, so the change is validated on a snapshot of the
+// config and then applied only if the config is still that snapshot (412 otherwise, even with If-Match: *).
+func applyServiceChange(w http.ResponseWriter, r *http.Request, fn func([]PipelineService) ([]PipelineService, error)) {
+	pipeline := chi.URLParam(r, "name")
+	if pipeline != "" {
+		if _, ok := ResolvePipeline(pipeline); !ok {
+			w.WriteHeader(http.StatusNotFound)
+			replyJSON(w, map[string]interface{}{"ok": false, "detail": "Pipeline not found: " + pipeline})
+			return
+		}
+	}
+	change := func(svc []PipelineService) ([]PipelineService, error) {
+		out, err := fn(svc)
+		if err != nil {
+			return nil, err
+		}
+		if detail := validateServices(out); detail != "" {
+			return nil, &serviceValidationError{detail: detail}
+		}
+		return out, nil
+	}
+	meta := changeMetaFromRequest(r)
+	var err error
+	if !skipValidation(r) {
+		snap := loadPipelineSet()
+		name := pipeline
+		if name == "" {
+			name = snap.Default
+		}
+		if !etagMatches(meta.IfMatch, pipelineETag(snap)) {
+			err = errPreconditionFailed
+		} else if out, cerr := change(snap.Pipelines[name]); cerr != nil {
+			err = cerr
+		} else {
+			opts := validateOptions{Network: validateNetworkDefault(), API: true, Existing: snap.Pipelines[name]}
+			if diags := validatePipeline(r.Context(), out, opts); hasErrors(diags) {
+				err = &serviceValidationError{detail: firstError(diags), diagnostics: diags}
+			}
+		}
+		meta.IfMatch = pipelineETag(snap)
+	}
+	var res commitResult
+	if err == nil {
+		res, err = UpdateNamedPipeline(pipeline, meta, change)
+	}
+	if replyPreconditionFailed(w, err) || replyInvalidPipeline(w, err) {
+		return
+	}
+	var verr *serviceValidationError
+	switch {
+	case errors.Is(err, errServiceNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Service not found: " + chi.URLParam(r, "service")})
+		return
+	case errors.As(err, &verr):
+		if verr.diagnostics != nil {
+			replyJSON(w, map[string]interface{}{"ok": false, "detail": verr.detail, "diagnostics": verr.diagnostics})
+			return
+		}
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": verr.detail})
+		return
+	case err != nil:
+		replyJSON(w, map[string]interface{}{"ok": true, "saved": false, "detail": err.Error()})
+		return
+	}
+	w.Header().Set("ETag", res.ETag)
+	ps := loadPipelineSet()
+	if pipeline == "" {
+		pipeline = ps.Default
+	}
+	replyJSON(w, map[string]interface{}{
+		"ok":       true,
+		"saved":    storeAuthoritative(),
+		"version":  res.Version,
+		"services": pipelineServicesOut(ps.Pipelines[pipeline]),
+	})
+}
+
+func apiServiceAdd(w http.ResponseWriter, r *http.Request) {
+	if !requireIfMatch(w, r) {
+		return
+	}
+	var body ServiceAdd
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Invalid JSON"})
+		return
+	}
+	s := serviceFromUpdate(body.PipelineServiceUpdate)
+	applyServiceChange(w, r, func(svc []PipelineService) ([]PipelineService, error) {
+		pos := len(svc)
+		if body.Position != nil {
+			pos = *body.Position
+		}
+		return insertService(svc, pos, s), nil
+	})
+}
+
+func apiServicePatch(w http.ResponseWriter, r *http.Request) {
+	if !requireIfMatch(w, r) {
+		return
+	}
+	name := chi.URLParam(r, "service")
+	var body ServicePatch
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Invalid JSON"})
+		return
+	}
+	applyServiceChange(w, r, func(svc []PipelineService) ([]PipelineService, error) {
+		i := serviceIndex(svc, name)
+		if i < 0 {
+			return nil, errServiceNotFound
+		}
+		out := make([]PipelineService, len(svc))
+		copy(out, svc)
+		s := &out[i]
+		if body.Name != nil {
+			s.Name = strings.TrimSpace(*body.Name)
+		}
+		if body.URL != nil {
+			s.URL = NormalizeURL(*body.URL)
+		}
+		if body.Icon != nil {
+			s.Icon = strings.TrimSpace(*body.Icon)
+			if s.Icon == "" {
+				s.Icon = "•"
+			}
+		}
+		if body.Description != nil {
+			s.Description = strings.TrimSpace(*body.Description)
+		}
+		if body.InputType != nil {
+			s.InputType = strings.TrimSpace(*body.InputType)
+		}
+		if body.OutputType != nil {
+			s.OutputType = strings.TrimSpace(*body.OutputType)
+		}
+		if body.Pipeline != nil {
+			s.Pipeline = strings.TrimSpace(*body.Pipeline)
+		}
+		if body.Include != nil {
+			s.Include = strings.TrimSpace(*body.Include)
+		}
+		if body.Endpoints != nil {
+			s.Endpoints = normalizeURLs(*body.Endpoints)
+		}
+		if body.Balance != nil {
+			s.Balance = strings.TrimSpace(*body.Balance)
+		}
+		if body.HashKey != nil {
+			s.HashKey = strings.TrimSpace(*body.HashKey)
+		}
+		if body.Variants != nil {
+			s.Variants = normalizeVariants(*body.Variants)
+		}
+		if body.StickyKey != nil {
+			s.StickyKey = strings.TrimSpace(*body.StickyKey)
+		}
+		if body.Shadow != nil {
+			s.Shadow = NormalizeURL(*body.Shadow)
+		}
+		if body.Hedge != nil {
+			s.Hedge = body.Hedge
+			if *body.Hedge == (HedgePolicy{}) {
+				s.Hedge = nil
+			}
+		}
+		if body.Fallback != nil {
+			s.Fallback = normalizeFallback(body.Fallback)
+		}
+		if body.OnError != nil {
+			s.OnError = strings.TrimSpace(*body.OnError)
+		}
+		if body.Compensate != nil {
+			s.Compensate = NormalizeURL(*body.Compensate)
+		}
+		return out, nil
+	})
+}
+
+func apiServiceDelete(w http.ResponseWriter, r *http.Request) {
+	if !requireIfMatch(w, r) {
+		return
+	}
+	name := chi.URLParam(r, "service")
+	applyServiceChange(w, r, func(svc []PipelineService) ([]PipelineService, error) {
+		i := serviceIndex(svc, name)
+		if i < 0 {
+			return nil, errServiceNotFound
+		}
+		return removeService(svc, i), nil
+	})
+}
+
+func apiServiceMove(w http.ResponseWriter, r *http.Request) {
+	if !requireIfMatch(w, r) {
+		return
+	}
+	name := chi.URLParam(r, "service")
+	var body ServiceMove
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Invalid JSON"})
+		return
+	}
+	if body.Position == nil && body.Before == nil && body.After == nil {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "One of position, before or after is required"})
+		return
+	}
+	applyServiceChange(w, r, func(svc []PipelineService) ([]PipelineService, error) {
+		i := serviceIndex(svc, name)
+		if i < 0 {
+			return nil, errServiceNotFound
+		}
+		s := svc[i]
+		out := removeService(svc, i)
+		pos := len(out)
+		switch {
+		case body.Position != nil:
+			pos = *body.Position
+		case body.Before != nil:
+			pos = serviceIndex(out, *body.Before)
+			if pos < 0 {
+				return nil, &serviceValidationError{detail: "Unknown service in before: " + *body.Before}
+			}
+		case body.After != nil:
+			pos = serviceIndex(out, *body.After)
+			if pos < 0 {
+				return nil, &serviceValidationError{detail: "Unknown service in after: " + *body.After}
+			}
+			pos++
+		}
+		return insertService(out, pos, s), nil
+	})
+}
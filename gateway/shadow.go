@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A service with shadow: <base URL> also sends every request body to that URL, in the background. The
+// shadow's reply never reaches the run; it is compared with the primary's (type, data and each metadata
+// key) and the outcome is counted per service for GET /api/shadow. Each shadow call is a trace of its own,
+// linked to the step span it copied.
+
+// shadowRecentMax is how many recent mismatches GET /api/shadow keeps per service.
+const shadowRecentMax = 20
+
+// shadowMismatch is one shadow reply that differed from the primary's.
+type shadowMismatch struct {
+	TraceID string    `json:"trace_id"`
+	Time    time.Time `json:"time"`
+	Fields  []string  `json:"fields"`
+	Primary string    `json:"primary"`
+	Shadow  string    `json:"shadow"`
+}
+
+// shadowStats are the comparisons of one service's shadow since the gateway started (or was reset).
+type shadowStats struct {
+	Service    string           `json:"service"`
+	URL        string           `json:"url"`
+	Requests   int64            `json:"requests"`   // copies sent
+	Matched    int64            `json:"matched"`    // same reply as the primary
+	Mismatched int64            `json:"mismatched"` // different reply
+	Errors     int64            `json:"errors"`     // shadow failed: network error, non-200 or not JSON
+	Skipped    int64            `json:"skipped"`    // primary failed, nothing to compare with
+	Dropped    int64            `json:"dropped"`    // not sent, SHADOW_MAX_IN_FLIGHT reached
+	Fields     map[string]int64 `json:"fields"`     // mismatches per field: type, data, metadata.<key>
+	Recent     []shadowMismatch `json:"recent"`     // newest first
+
+	primaryNanos int64 // summed latencies of compared calls, for the means
+	shadowNanos  int64
+}
+
+type shadowRegistry struct {
+	mu        sync.Mutex
+	byService map[string]*shadowStats
+	inFlight  chan struct{}
+}
+
+var shadows = &shadowRegistry{
+	byService: make(map[string]*shadowStats),
+	inFlight:  make(chan struct{}, shadowMaxInFlight()),
+}
+
+// shadowMaxInFlight caps concurrent shadow calls (SHADOW_MAX_IN_FLIGHT, default 100) so a slow shadow
+// cannot pile up goroutines; copies beyond it are dropped.
+func shadowMaxInFlight() int {
+	if n, err := strconv.Atoi(os.Getenv("SHADOW_MAX_IN_FLIGHT")); err == nil && n > 0 {
+		return n
+	}
+	return 100
+}
+
+var shadowClient = &http.Client{Timeout: 120 * time.Second}
+
+// statsLocked returns the stats of service, starting over when its shadow URL changed. Caller must hold reg.mu.
+func (reg *shadowRegistry) statsLocked(service, url string) *shadowStats {
+	st, ok := reg.byService[service]
+	if !ok || st.URL != url {
+		st = &shadowStats{Service: service, URL: url, Fields: map[string]int64{}, Recent: []shadowMismatch{}}
+		reg.byService[service] = st
+	}
+	return st
+}
+
+// shadowCall is a shadow request in flight. The step hands it the primary's outcome with done.
+type shadowCall struct {
+	primary chan shadowPrimary
+}
+
+type shadowPrimary struct {
+	payload map[string]interface{} // nil when the primary failed
+	latency time.Duration
+}
+
+// startShadow sends body to the shadow of svc in the background, or returns nil when svc has none or
+// too many shadow calls are in flight. ctx is the step's context; the shadow span links to its span.
+func startShadow(ctx context.Context, svc PipelineService, body []byte) *shadowCall {
+	if svc.Shadow == "" {
+		return nil
+	}
+	select {
+	case shadows.inFlight <- struct{}{}:
+	default:
+		shadows.mu.Lock()
+		shadows.statsLocked(svc.Name, svc.Shadow).Dropped++
+		shadows.mu.Unlock()
+		return nil
+	}
+	sc := &shadowCall{primary: make(chan shadowPrimary, 1)}
+	traceID := trace.SpanContextFromContext(ctx).TraceID().String()
+	// Keep the run's baggage but not its cancellation: the run may finish before the shadow does.
+	ctx, span := otel.Tracer("gateway").Start(context.WithoutCancel(ctx), "shadow "+svc.Name,
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx, attribute.String("link.type", "shadow_of"))),
+		trace.WithAttributes(
+			attribute.String("shadow.service", svc.Name),
+			attribute.String("shadow.url", svc.Shadow),
+			attribute.String("shadow.primary_trace_id", traceID),
+		),
+	)
+	go func() {
+		defer func() { <-shadows.inFlight }()
+		defer span.End()
+		start := time.Now()
+		reply, err := shadowPost(ctx, svc.Shadow, body)
+		latency := time.Since(start)
+		p := <-sc.primary
+		shadows.record(ctx, span, svc, traceID, p, reply, latency, err)
+	}()
+	return sc
+}
+
+// done passes the primary's outcome (nil payload when it failed) to the shadow call, if any.
+func (sc *shadowCall) done(payload map[string]interface{}, latency time.Duration) {
+	if sc != nil {
+		sc.primary <- shadowPrimary{payload: payload, latency: latency}
+	}
+}
+
+func shadowPost(ctx context.Context, base string, body []byte) (map[string]interface{}, error) {
+	resp, err := postWithTrace(ctx, shadowClient, strings.TrimRight(base, "/")+"/", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, &httpStatusError{status: resp.StatusCode}
+	}
+	var data map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return normalizeIncoming(data), nil
+}
+
+// diffPayloads returns the fields in which two normalized payloads differ.
+func diffPayloads(a, b map[string]interface{}) []string {
+	var fields []string
+	for _, k := range []string{"type", "data"} {
+		if !reflect.DeepEqual(a[k], b[k]) {
+			fields = append(fields, k)
+		}
+	}
+	ma, _ := a["metadata"].(map[string]interface{})
+	mb, _ := b["metadata"].(map[string]interface{})
+	keys := map[string]bool{}
+	for k := range ma {
+		keys[k] = true
+	}
+	for k := range mb {
+		keys[k] = true
+	}
+	var meta []string
+	for k := range keys {
+		va, oka := ma[k]
+		vb, okb := mb[k]
+		if oka != okb || !reflect.DeepEqual(va, vb) {
+			meta = append(meta, "metadata."+k)
+		}
+	}
+	sort.Strings(meta)
+	return append(fields, meta...)
+}
+
+// record counts the outcome of one shadow call and sets it on its span.
+func (reg *shadowRegistry) record(ctx context.Context, span trace.Span, svc PipelineService, traceID string, p shadowPrimary, reply map[string]interface{}, latency time.Duration, err error) {
+	result := "error"
+	var fields []string
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case p.payload == nil:
+		result = "skipped"
+	default:
+		fields = diffPayloads(p.payload, reply)
+		result = "match"
+		if len(fields) > 0 {
+			result = "mismatch"
+		}
+	}
+	span.SetAttributes(attribute.String("shadow.result", result))
+	if len(fields) > 0 {
+		span.SetAttributes(attribute.StringSlice("shadow.diff_fields", fields))
+	}
+	pipelineMetrics.RecordShadow(ctx, svc.Name, result)
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	st := reg.statsLocked(svc.Name, svc.Shadow)
+	st.Requests++
+	switch result {
+	case "error":
+		st.Errors++
+		logger.WarnContext(ctx, "shadow call failed", "service", svc.Name, "url", svc.Shadow, "error", err)
+		return
+	case "skipped":
+		st.Skipped++
+		return
+	case "match":
+		st.Matched++
+	default:
+		st.Mismatched++
+		for _, f := range fields {
+			st.Fields[f]++
+		}
+		m := shadowMismatch{TraceID: traceID, Time: time.Now().UTC(), Fields: fields, Primary: previewPayload(p.payload), Shadow: previewPayload(reply)}
+		st.Recent = append([]shadowMismatch{m}, st.Recent[:min(len(st.Recent), shadowRecentMax-1)]...)
+	}
+	st.primaryNanos += int64(p.latency)
+	st.shadowNanos += int64(latency)
+}
+
+// shadowStatsOut is one service in GET /api/shadow. The means cover compared calls; all three are null
+// until there is one.
+type shadowStatsOut struct {
+	shadowStats
+	MatchRate     *float64 `json:"match_rate"`
+	PrimaryMeanMs *float64 `json:"primary_mean_ms"`
+	ShadowMeanMs  *float64 `json:"shadow_mean_ms"`
+}
+
+// apiShadowList returns the shadow statistics of every service that has (or had) a shadow.
+func apiShadowList(w http.ResponseWriter, r *http.Request) {
+	shadows.mu.Lock()
+	out := make([]shadowStatsOut, 0, len(shadows.byService))
+	for _, st := range shadows.byService {
+		o := shadowStatsOut{shadowStats: *st}
+		o.Fields = make(map[string]int64, len(st.Fields))
+		for k, v := range st.Fields {
+			o.Fields[k] = v
+		}
+		o.Recent = append([]shadowMismatch{}, st.Recent...)
+		if compared := float64(st.Matched + st.Mismatched); compared > 0 {
+			rate := float64(st.Matched) / compared
+			primary := float64(st.primaryNanos) / compared / 1e6
+			shadow := float64(st.shadowNanos) / compared / 1e6
+			o.MatchRate, o.PrimaryMeanMs, o.ShadowMeanMs = &rate, &primary, &shadow
+		}
+		out = append(out, o)
+	}
+	shadows.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Service < out[j].Service })
+	replyJSON(w, map[string]interface{}{"services": out})
+}
+
+// apiShadowReset clears the shadow statistics.
+func apiShadowReset(w http.ResponseWriter, r *http.Request) {
+	shadows.mu.Lock()
+	shadows.byService = make(map[string]*shadowStats)
+	shadows.mu.Unlock()
+	replyJSON(w, map[string]interface{}{"ok": true})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigSource records where the active pipeline config came from.
+type ConfigSource struct {
+	Kind        string        `json:"kind"` // configured, example, defaults, api, or the store: writable, sqlite, consul, etcd
+	Path        string        `json:"path,omitempty"`
+	ModTime     *time.Time    `json:"mtime,omitempty"`
+	SHA256      string        `json:"sha256,omitempty"`
+	LoadedAt    time.Time     `json:"loaded_at"`
+	Fallback    bool          `json:"fallback"` // true when loaded from an example file or the built-in defaults
+	Errors      []sourceError `json:"errors"`   // paths tried first and why they were skipped
+	ReloadError string        `json:"reload_error,omitempty"`
+}
+
+type sourceError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// dataSource describes config read from (or written as) data.
+func dataSource(kind, path string, data []byte) ConfigSource {
+	sum := sha256.Sum256(data)
+	return ConfigSource{Kind: kind, Path: path, SHA256: hex.EncodeToString(sum[:]), LoadedAt: time.Now().UTC()}
+}
+
+// readPipelineSource reads and parses path, returning its provenance even when parsing fails.
+func readPipelineSource(path, kind string) (*pipelineSet, ConfigSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, ConfigSource{Kind: kind, Path: path, LoadedAt: time.Now().UTC()}, err
+	}
+	src := dataSource(kind, path, data)
+	if info, err := os.Stat(path); err == nil {
+		t := info.ModTime().UTC()
+		src.ModTime = &t
+	}
+	ps, err := parsePipelineData(data)
+	return ps, src, err
+}
+
+// readStoreSource reads and parses the config in st. rev is the revision read, "" if nothing is stored.
+func readStoreSource(st ConfigStore) (*pipelineSet, ConfigSource, string, error) {
+	sc, err := st.Get(context.Background())
+	if err != nil {
+		return nil, ConfigSource{Kind: st.Kind(), Path: st.Location(), LoadedAt: time.Now().UTC()}, "", err
+	}
+	src := dataSource(st.Kind(), st.Location(), sc.Data)
+	if !sc.ModTime.IsZero() {
+		t := sc.ModTime.UTC()
+		src.ModTime = &t
+	}
+	ps, err := parsePipelineData(sc.Data)
+	return ps, src, sc.Revision, err
+}
+
+// parsePipelineData parses a pipeline.yaml document and resolves its references.
+func parsePipelineData(data []byte) (*pipelineSet, error) {
+	var cfg pipelineConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	ps := cfg.toSet()
+	if ps == nil {
+		return nil, errors.New("no services defined")
+	}
+	if err := ps.resolve(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// PipelineSource returns the provenance of the active config, loading it first if needed.
+func PipelineSource() ConfigSource {
+	loadPipelineSet()
+	configMu.RLock()
+	defer configMu.RUnlock()
+	src := configSource
+	src.Errors = append([]sourceError{}, src.Errors...)
+	return src
+}
+
+// setReloadError records (or with "" clears) the error of the last attempt to reload the config file.
+func setReloadError(msg string) {
+	configMu.Lock()
+	configSource.ReloadError = msg
+	configMu.Unlock()
+}
+
+// strictConfig reports whether PIPELINE_STRICT=true: refuse to start unless the configured file loads and validates.
+func strictConfig() bool {
+	return strings.ToLower(os.Getenv("PIPELINE_STRICT")) == "true"
+}
+
+// checkPipelineSource logs where the config came from and, in strict mode, returns an error when it is a
+// fallback (configured file missing or unparsable) or fails validation.
+func checkPipelineSource() error {
+	src := PipelineSource()
+	attrs := []any{"kind", src.Kind, "path", src.Path, "sha256", src.SHA256}
+	if src.ModTime != nil {
+		attrs = append(attrs, "mtime", src.ModTime.Format(time.RFC3339))
+	}
+	for _, e := range src.Errors {
+		logger.Warn("pipeline config candidate skipped", "path", e.Path, "error", e.Error)
+	}
+	if src.Fallback {
+		logger.Warn("pipeline config loaded from fallback", attrs...)
+	} else {
+		logger.Info("pipeline config loaded", attrs...)
+	}
+	if !strictConfig() {
+		return nil
+	}
+	if src.Fallback {
+		if len(src.Errors) > 0 {
+			return fmt.Errorf("strict mode: configured pipeline file %s not loaded: %s", src.Errors[0].Path, src.Errors[0].Error)
+		}
+		return fmt.Errorf("strict mode: pipeline config loaded from fallback %s", src.Kind)
+	}
+	if err := validatePipelineSet(loadPipelineSet()); err != nil {
+		return fmt.Errorf("strict mode: %w", err)
+	}
+	return nil
+}
+
+func apiPipelineSource(w http.ResponseWriter, r *http.Request) {
+	src := PipelineSource()
+	ps := loadPipelineSet()
+	replyJSON(w, map[string]interface{}{
+		"source":  src,
+		"version": ps.Version,
+		"etag":    pipelineETag(ps),
+		"strict":  strictConfig(),
+	})
+}
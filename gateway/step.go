@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// stepCall is the outcome of calling one service of a run. On success payload and steps are the run's new
+// state and last is the service's own entry in steps (empty if it added none).
+type stepCall struct {
+	payload  map[string]interface{}
+	steps    []interface{}
+	last     map[string]interface{}
+	variant  string // canary variant that served the step ("" for services without variants)
+	fallback string // fallback kind used because the service failed ("" if it did not)
+	err      error
+	detail   string // error reported to the client: the service's error body, or err
+}
+
+// callService sends payload and steps to svc, or to the canary variant picked for this run, in a
+// "step <name>" span and decodes its reply. A copy goes to the service's shadow, if it has one, and the
+// service's fallback replaces it when it fails.
+func callService(ctx context.Context, client *http.Client, svc PipelineService, payload map[string]interface{}, steps []interface{}) (call stepCall) {
+	target, variant := pickVariant(ctx, svc, payload)
+	attrs := []attribute.KeyValue{attribute.String("step.service", svc.Name)}
+	if variant != "" {
+		attrs = append(attrs, attribute.String("step.variant", variant))
+	}
+	if svc.Shadow != "" {
+		attrs = append(attrs, attribute.String("step.shadow", svc.Shadow))
+	}
+	ctx, span := otel.Tracer("gateway").Start(ctx, "step "+svc.Name, trace.WithAttributes(attrs...))
+	defer span.End()
+	call.variant = variant
+	start := time.Now()
+	body, _ := json.Marshal(bodyForService(payload, steps))
+	pipelineMetrics.RecordPayload(ctx, svc.Name, len(body))
+	var primary map[string]interface{} // the primary's reply, for the shadow to compare with
+	shadow := startShadow(ctx, svc, body)
+	defer func() { shadow.done(primary, time.Since(start)) }()
+
+	data, detail, err := postStep(ctx, client, target, body, payload, svc.Hedge)
+	if err == nil {
+		primary = normalizeIncoming(data)
+	} else if svc.Fallback != nil {
+		primaryDetail := detail
+		if data, err = runFallback(ctx, client, svc, body, payload, steps, err); err != nil {
+			detail = primaryDetail + "; fallback: " + err.Error()
+		} else {
+			call.fallback, detail = svc.Fallback.kind(), primaryDetail
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		recordStep(ctx, svc.Name, "error", start, err)
+		call.err, call.detail = err, detail
+		return call
+	}
+	call.payload = normalizeIncoming(data)
+	call.steps = steps
+	if s, ok := data["steps"].([]interface{}); ok {
+		call.steps = s
+	}
+	call.last = tagStep(call.steps, svc)
+	if variant != "" && len(call.steps) > 0 {
+		call.last["variant"] = variant
+	}
+	if call.fallback != "" && len(call.steps) > 0 {
+		call.last["status"] = "fallback"
+		call.last["fallback"] = call.fallback
+		call.last["error"] = detail
+	}
+	recordStep(ctx, svc.Name, getStr(call.last, "status", "ok"), start, nil)
+	return call
+}
+
+// postStep posts body to target's endpoints and decodes the reply. detail is what to report for err: the
+// service's error body, or err itself.
+func postStep(ctx context.Context, client *http.Client, target PipelineService, body []byte, payload map[string]interface{}, hedge *HedgePolicy) (map[string]interface{}, string, error) {
+	resp, err := PostWithRetryAndCircuit(ctx, client, balancerFor(target), "/", "application/json", body, balanceKey(target, payload), hedge)
+	if err != nil {
+		return nil, err.Error(), err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, string(bodyBytes), &httpStatusError{status: resp.StatusCode}
+	}
+	var data map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err.Error(), err
+	}
+	return data, "", nil
+}
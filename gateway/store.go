@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigStore holds the writable pipeline config so replicas share it. The config is stored in the
+// pipeline.yaml format; revisions are opaque strings used for compare-and-swap writes.
+type ConfigStore interface {
+	// Kind is the provenance kind reported by /api/pipeline/source ("writable" for the file store).
+	Kind() string
+	// Location is the file, database or key URL, for logs and /api/pipeline/source.
+	Location() string
+	// Get returns the stored config, or errConfigNotStored when nothing has been stored yet.
+	Get(ctx context.Context) (storedConfig, error)
+	// Put stores data if the stored revision is still rev ("" = nothing stored yet) and returns the new
+	// revision ("" if the store cannot tell). Returns errStoreConflict if the config changed in between.
+	Put(ctx context.Context, data []byte, rev string) (string, error)
+	// Watch calls onChange whenever the stored config may have changed. It blocks until ctx is done.
+	Watch(ctx context.Context, onChange func()) error
+}
+
+type storedConfig struct {
+	Data     []byte
+	Revision string
+	ModTime  time.Time // zero if the store does not track it
+}
+
+var (
+	errConfigNotStored = errors.New("no pipeline config stored")
+	errStoreConflict   = errors.New("pipeline config store revision changed")
+)
+
+// storeLocker is implemented by stores that need a cross-replica lock around read-modify-write.
+type storeLocker interface {
+	Lock() (func(), error)
+}
+
+// revisionChecker is implemented by stores that can cheaply tell whether rev is still current, so the
+// cached config is revalidated on every load. Other stores rely on Watch to invalidate it, and so does the
+// file store while its watch is running.
+type revisionChecker interface {
+	Current(rev string) bool
+}
+
+// configStore is nil when the config only lives in memory (no CONFIG_STORE or WRITABLE_PIPELINE_PATH).
+var configStore ConfigStore
+
+// storeAuthoritative returns true when the config is read from and written to a ConfigStore.
+func storeAuthoritative() bool {
+	return configStore != nil
+}
+
+// storeLocation is the store's location for logs, "" when the config lives in memory.
+func storeLocation() string {
+	if configStore == nil {
+		return ""
+	}
+	return configStore.Location()
+}
+
+// initConfigStore selects the store from CONFIG_STORE: file (WRITABLE_PIPELINE_PATH), sqlite
+// (CONFIG_STORE_PATH), consul or etcd (CONFIG_STORE_URL, CONFIG_STORE_KEY, CONFIG_STORE_TOKEN).
+// Without CONFIG_STORE, WRITABLE_PIPELINE_PATH selects the file store, else the config lives in memory.
+func initConfigStore() error {
+	kind := strings.ToLower(strings.TrimSpace(os.Getenv("CONFIG_STORE")))
+	if kind == "" && getWritablePath() != "" {
+		kind = "file"
+	}
+	switch kind {
+	case "", "memory":
+		return nil
+	case "file":
+		if getWritablePath() == "" {
+			return errors.New("CONFIG_STORE=file requires WRITABLE_PIPELINE_PATH")
+		}
+		configStore = &fileStore{path: getWritablePath()}
+	case "sqlite":
+		path := os.Getenv("CONFIG_STORE_PATH")
+		if path == "" {
+			path = "pipeline.db"
+		}
+		st, err := openSQLiteStore(path)
+		if err != nil {
+			return err
+		}
+		configStore = st
+	case "consul", "etcd":
+		base := strings.TrimRight(os.Getenv("CONFIG_STORE_URL"), "/")
+		if base == "" {
+			return fmt.Errorf("CONFIG_STORE=%s requires CONFIG_STORE_URL", kind)
+		}
+		key := strings.Trim(os.Getenv("CONFIG_STORE_KEY"), "/")
+		if key == "" {
+			key = "tracems/pipeline"
+		}
+		configStore = newHTTPKVStore(kind, base, key, os.Getenv("CONFIG_STORE_TOKEN"))
+	default:
+		return fmt.Errorf("unknown CONFIG_STORE %q (file, sqlite, consul, etcd)", kind)
+	}
+	logger.Info("pipeline config store", "kind", configStore.Kind(), "location", configStore.Location())
+	return nil
+}
+
+// storePollInterval is how often stores without change notifications are polled (CONFIG_STORE_POLL_INTERVAL).
+func storePollInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("CONFIG_STORE_POLL_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return 2 * time.Second
+}
+
+// fileStore keeps the config in a YAML file, e.g. on a volume shared by all replicas. Writes are atomic
+// renames under an advisory lock on "<path>.lock"; the revision is the file's mtime and size.
+type fileStore struct {
+	path     string
+	watching atomic.Bool // Watch is running, so changes mark the cache stale without a stat per load
+}
+
+func (s *fileStore) Kind() string     { return "writable" }
+func (s *fileStore) Location() string { return s.path }
+
+func fileRevision(info os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
+
+func (s *fileStore) Get(ctx context.Context) (storedConfig, error) {
+	f, err := os.Open(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return storedConfig{}, errConfigNotStored
+	}
+	if err != nil {
+		return storedConfig{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return storedConfig{}, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return storedConfig{}, err
+	}
+	return storedConfig{Data: data, Revision: fileRevision(info), ModTime: info.ModTime()}, nil
+}
+
+func (s *fileStore) Current(rev string) bool {
+	if s.watching.Load() {
+		return true
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return rev == ""
+	}
+	return fileRevision(info) == rev
+}
+
+// Put must be called with the lock from Lock held.
+func (s *fileStore) Put(ctx context.Context, data []byte, rev string) (string, error) {
+	if !s.Current(rev) {
+		return "", errStoreConflict
+	}
+	if err := writeFileAtomic(s.path, data, 0644); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return "", nil
+	}
+	return fileRevision(info), nil
+}
+
+func (s *fileStore) Lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return nil, err
+	}
+	return lockFile(s.path + ".lock")
+}
+
+func (s *fileStore) Watch(ctx context.Context, onChange func()) error {
+	if err := watchFile(ctx, s.path, onChange); err != nil {
+		return err
+	}
+	s.watching.Store(true)
+	defer s.watching.Store(false)
+	<-ctx.Done()
+	return nil
+}
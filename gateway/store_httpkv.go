@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpKVStore keeps the config under one key of a Consul KV or etcd v3 (JSON gateway) HTTP API.
+// Writes are compare-and-swap on the key's modify index / mod revision; Watch uses Consul blocking
+// queries or the etcd watch stream.
+type httpKVStore struct {
+	api    string // consul or etcd
+	base   string
+	key    string
+	token  string
+	client *http.Client
+}
+
+func newHTTPKVStore(api, base, key, token string) *httpKVStore {
+	return &httpKVStore{api: api, base: base, key: key, token: token, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *httpKVStore) Kind() string { return s.api }
+
+func (s *httpKVStore) Location() string {
+	if s.api == "consul" {
+		return s.base + "/v1/kv/" + s.key
+	}
+	return s.base + "#" + s.key
+}
+
+func (s *httpKVStore) do(ctx context.Context, client *http.Client, method, u string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		if s.api == "consul" {
+			req.Header.Set("X-Consul-Token", s.token)
+		} else {
+			req.Header.Set("Authorization", s.token)
+		}
+	}
+	if s.api == "etcd" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return client.Do(req)
+}
+
+// call sends a request and decodes a 2xx JSON response into out. Returns the response for headers.
+func (s *httpKVStore) call(ctx context.Context, method, u string, body []byte, out interface{}) (*http.Response, error) {
+	resp, err := s.do(ctx, s.client, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return resp, errConfigNotStored
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp, fmt.Errorf("%s %s: HTTP %d: %s", method, u, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+// kvInt decodes int64 values that etcd's JSON gateway sends as strings (and Consul as numbers).
+type kvInt int64
+
+func (n *kvInt) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+	*n = kvInt(v)
+	return nil
+}
+
+type consulKV struct {
+	Value       []byte // base64 in JSON
+	ModifyIndex kvInt
+}
+
+type etcdKV struct {
+	Value       []byte `json:"value"`
+	ModRevision kvInt  `json:"mod_revision"`
+}
+
+type etcdHeader struct {
+	Revision kvInt `json:"revision"`
+}
+
+func (s *httpKVStore) b64Key() string {
+	return base64.StdEncoding.EncodeToString([]byte(s.key))
+}
+
+func (s *httpKVStore) Get(ctx context.Context) (storedConfig, error) {
+	if s.api == "consul" {
+		var kvs []consulKV
+		if _, err := s.call(ctx, "GET", s.base+"/v1/kv/"+s.key, nil, &kvs); err != nil {
+			return storedConfig{}, err
+		}
+		if len(kvs) == 0 {
+			return storedConfig{}, errConfigNotStored
+		}
+		return storedConfig{Data: kvs[0].Value, Revision: strconv.FormatInt(int64(kvs[0].ModifyIndex), 10)}, nil
+	}
+	body, _ := json.Marshal(map[string]string{"key": s.b64Key()})
+	var out struct {
+		Kvs []etcdKV `json:"kvs"`
+	}
+	if _, err := s.call(ctx, "POST", s.base+"/v3/kv/range", body, &out); err != nil {
+		return storedConfig{}, err
+	}
+	if len(out.Kvs) == 0 {
+		return storedConfig{}, errConfigNotStored
+	}
+	return storedConfig{Data: out.Kvs[0].Value, Revision: strconv.FormatInt(int64(out.Kvs[0].ModRevision), 10)}, nil
+}
+
+func (s *httpKVStore) Put(ctx context.Context, data []byte, rev string) (string, error) {
+	if rev == "" {
+		rev = "0" // both APIs treat index/revision 0 as "key must not exist"
+	}
+	if s.api == "consul" {
+		var ok bool
+		if _, err := s.call(ctx, "PUT", s.base+"/v1/kv/"+s.key+"?cas="+url.QueryEscape(rev), data, &ok); err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", errStoreConflict
+		}
+		// Consul does not return the new index; read it back, unless someone has already written again.
+		cur, err := s.Get(ctx)
+		if err != nil || !bytes.Equal(cur.Data, data) {
+			return "", nil
+		}
+		return cur.Revision, nil
+	}
+	txn := map[string]interface{}{
+		"compare": []map[string]interface{}{{
+			"key": s.b64Key(), "target": "MOD", "result": "EQUAL", "mod_revision": rev,
+		}},
+		"success": []map[string]interface{}{{
+			"request_put": map[string]string{"key": s.b64Key(), "value": base64.StdEncoding.EncodeToString(data)},
+		}},
+	}
+	body, _ := json.Marshal(txn)
+	var out struct {
+		Header    etcdHeader `json:"header"`
+		Succeeded bool       `json:"succeeded"`
+	}
+	if _, err := s.call(ctx, "POST", s.base+"/v3/kv/txn", body, &out); err != nil {
+		return "", err
+	}
+	if !out.Succeeded {
+		return "", errStoreConflict
+	}
+	return strconv.FormatInt(int64(out.Header.Revision), 10), nil
+}
+
+// Watch reconnects after errors, waiting CONFIG_STORE_POLL_INTERVAL, and reports a possible change
+// after each reconnect since events may have been missed.
+func (s *httpKVStore) Watch(ctx context.Context, onChange func()) error {
+	for {
+		var err error
+		if s.api == "consul" {
+			err = s.watchConsul(ctx, onChange)
+		} else {
+			err = s.watchEtcd(ctx, onChange)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			logger.Warn("pipeline config store watch interrupted", "store", s.api, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(storePollInterval()):
+		}
+		onChange()
+	}
+}
+
+// watchConsul runs blocking queries on the key until one fails.
+func (s *httpKVStore) watchConsul(ctx context.Context, onChange func()) error {
+	client := &http.Client{} // blocking queries outlive s.client's timeout; ctx bounds them
+	index := "0"
+	for {
+		resp, err := s.do(ctx, client, "GET", s.base+"/v1/kv/"+s.key+"?wait=5m&index="+index, nil)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("watch: HTTP %d", resp.StatusCode)
+		}
+		next := resp.Header.Get("X-Consul-Index")
+		if next == "" {
+			return fmt.Errorf("watch: no X-Consul-Index header")
+		}
+		if index != "0" && next != index {
+			onChange()
+		}
+		if n, _ := strconv.ParseInt(next, 10, 64); n <= 0 {
+			next = "0"
+		}
+		index = next
+	}
+}
+
+// watchEtcd reads the etcd watch stream until it ends.
+func (s *httpKVStore) watchEtcd(ctx context.Context, onChange func()) error {
+	body, _ := json.Marshal(map[string]interface{}{"create_request": map[string]string{"key": s.b64Key()}})
+	resp, err := s.do(ctx, &http.Client{}, "POST", s.base+"/v3/watch", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("watch: HTTP %d", resp.StatusCode)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Events []json.RawMessage `json:"events"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if len(msg.Result.Events) > 0 {
+			onChange()
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKV is a local stand-in for the parts of the Consul KV and etcd v3 JSON gateway APIs that
+// httpKVStore uses: one key, compare-and-swap writes, Consul blocking queries and the etcd watch stream.
+type fakeKV struct {
+	key string
+
+	mu       sync.Mutex
+	value    []byte
+	index    int64         // modify index / mod revision of the key, 0 if it does not exist
+	revision int64         // store revision, bumped by each write
+	changed  chan struct{} // closed and replaced by each write
+	watching chan struct{} // receives when a watch request starts waiting for a change
+}
+
+func newFakeKV(key string) *fakeKV {
+	return &fakeKV{key: key, changed: make(chan struct{}), watching: make(chan struct{}, 16)}
+}
+
+// put stores value if the key's index is still cas, as both APIs do.
+func (f *fakeKV) put(value []byte, cas int64) (int64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cas != f.index {
+		return f.revision, false
+	}
+	f.revision++
+	f.value, f.index = value, f.revision
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return f.revision, true
+}
+
+func (f *fakeKV) state() (value []byte, index int64, changed chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.value, f.index, f.changed
+}
+
+func (f *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/kv/"+f.key && r.Method == "GET":
+		f.consulGet(w, r)
+	case r.URL.Path == "/v1/kv/"+f.key && r.Method == "PUT":
+		cas, _ := strconv.ParseInt(r.URL.Query().Get("cas"), 10, 64)
+		data, _ := io.ReadAll(r.Body)
+		_, ok := f.put(data, cas)
+		json.NewEncoder(w).Encode(ok)
+	case r.URL.Path == "/v3/kv/range":
+		value, index, _ := f.state()
+		out := map[string]interface{}{"header": map[string]string{"revision": strconv.FormatInt(index, 10)}}
+		if index > 0 {
+			out["kvs"] = []map[string]string{{"value": base64.StdEncoding.EncodeToString(value), "mod_revision": strconv.FormatInt(index, 10)}}
+		}
+		json.NewEncoder(w).Encode(out)
+	case r.URL.Path == "/v3/kv/txn":
+		f.etcdTxn(w, r)
+	case r.URL.Path == "/v3/watch":
+		f.etcdWatch(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// consulGet answers reads and blocking queries (?index=N waits until the index is no longer N).
+func (f *fakeKV) consulGet(w http.ResponseWriter, r *http.Request) {
+	value, index, changed := f.state()
+	if wait := r.URL.Query().Get("index"); wait != "" && wait == strconv.FormatInt(index, 10) {
+		f.watching <- struct{}{}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		value, index, _ = f.state()
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatInt(max(index, 1), 10))
+	if index == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode([]map[string]interface{}{{"Value": value, "ModifyIndex": index}})
+}
+
+func (f *fakeKV) etcdTxn(w http.ResponseWriter, r *http.Request) {
+	var txn struct {
+		Compare []struct {
+			ModRevision kvInt `json:"mod_revision"`
+		} `json:"compare"`
+		Success []struct {
+			RequestPut struct {
+				Value []byte `json:"value"`
+			} `json:"request_put"`
+		} `json:"success"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil || len(txn.Compare) != 1 || len(txn.Success) != 1 {
+		http.Error(w, "bad txn", http.StatusBadRequest)
+		return
+	}
+	rev, ok := f.put(txn.Success[0].RequestPut.Value, int64(txn.Compare[0].ModRevision))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"header":    map[string]string{"revision": strconv.FormatInt(rev, 10)},
+		"succeeded": ok,
+	})
+}
+
+// etcdWatch streams a created message, then one event message per write until the client goes away.
+func (f *fakeKV) etcdWatch(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]interface{}{"result": map[string]interface{}{"created": true}})
+	w.(http.Flusher).Flush()
+	for {
+		_, _, changed := f.state()
+		f.watching <- struct{}{}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		_, index, _ := f.state()
+		enc.Encode(map[string]interface{}{"result": map[string]interface{}{
+			"events": []map[string]interface{}{{"kv": map[string]string{"mod_revision": strconv.FormatInt(index, 10)}}},
+		}})
+		w.(http.Flusher).Flush()
+	}
+}
+
+func TestHTTPKVStoreCompareAndSwap(t *testing.T) {
+	for _, api := range []string{"consul", "etcd"} {
+		t.Run(api, func(t *testing.T) {
+			srv := httptest.NewServer(newFakeKV("gateway/pipeline"))
+			defer srv.Close()
+			s := newHTTPKVStore(api, srv.URL, "gateway/pipeline", "")
+			ctx := context.Background()
+
+			if _, err := s.Get(ctx); !errors.Is(err, errConfigNotStored) {
+				t.Fatalf("Get on an empty store: got %v, want errConfigNotStored", err)
+			}
+			rev1, err := s.Put(ctx, []byte("services: []\n"), "")
+			if err != nil || rev1 == "" {
+				t.Fatalf("first Put: rev %q, err %v", rev1, err)
+			}
+			if _, err := s.Put(ctx, []byte("services: [a]\n"), ""); !errors.Is(err, errStoreConflict) {
+				t.Fatalf("Put expecting an empty store after a write: got %v, want errStoreConflict", err)
+			}
+			got, err := s.Get(ctx)
+			if err != nil || string(got.Data) != "services: []\n" || got.Revision != rev1 {
+				t.Fatalf("Get: %q at %q, err %v; want the first write at %q", got.Data, got.Revision, err, rev1)
+			}
+			rev2, err := s.Put(ctx, []byte("services: [b]\n"), rev1)
+			if err != nil || rev2 == "" || rev2 == rev1 {
+				t.Fatalf("Put at the current revision: rev %q, err %v", rev2, err)
+			}
+			if _, err := s.Put(ctx, []byte("services: [c]\n"), rev1); !errors.Is(err, errStoreConflict) {
+				t.Fatalf("Put at a stale revision: got %v, want errStoreConflict", err)
+			}
+			if got, _ := s.Get(ctx); string(got.Data) != "services: [b]\n" || got.Revision != rev2 {
+				t.Fatalf("Get after the conflict: %q at %q, want the second write at %q", got.Data, got.Revision, rev2)
+			}
+		})
+	}
+}
+
+func TestHTTPKVStoreWatchWakesOnWrite(t *testing.T) {
+	for _, api := range []string{"consul", "etcd"} {
+		t.Run(api, func(t *testing.T) {
+			kv := newFakeKV("gateway/pipeline")
+			srv := httptest.NewServer(kv)
+			defer srv.Close()
+			s := newHTTPKVStore(api, srv.URL, "gateway/pipeline", "")
+			rev, err := s.Put(context.Background(), []byte("services: []\n"), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			changes := make(chan struct{}, 16)
+			done := make(chan error, 1)
+			go func() { done <- s.Watch(ctx, func() { changes <- struct{}{} }) }()
+
+			waitFor(t, kv.watching, "the watch to start waiting")
+			select {
+			case <-changes:
+				t.Fatal("onChange called before any write")
+			default:
+			}
+			// A write from another replica wakes the blocked watch.
+			other := newHTTPKVStore(api, srv.URL, "gateway/pipeline", "")
+			if _, err := other.Put(context.Background(), []byte("services: [a]\n"), rev); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, changes, "onChange after a write")
+
+			cancel()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Watch returned %v after cancel, want nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Watch did not return after cancel")
+			}
+		})
+	}
+}
+
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStore keeps the config in a single-row table. The revision is a counter bumped on every write;
+// Watch polls it every CONFIG_STORE_POLL_INTERVAL.
+type sqliteStore struct {
+	db   *sql.DB
+	path string
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS pipeline_config (
+		id         INTEGER PRIMARY KEY CHECK (id = 1),
+		data       BLOB    NOT NULL,
+		revision   INTEGER NOT NULL,
+		updated_at TEXT    NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db, path: path}, nil
+}
+
+func (s *sqliteStore) Kind() string     { return "sqlite" }
+func (s *sqliteStore) Location() string { return s.path }
+
+func (s *sqliteStore) Get(ctx context.Context) (storedConfig, error) {
+	var (
+		data    []byte
+		rev     int64
+		updated string
+	)
+	err := s.db.QueryRowContext(ctx, `SELECT data, revision, updated_at FROM pipeline_config WHERE id = 1`).Scan(&data, &rev, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storedConfig{}, errConfigNotStored
+	}
+	if err != nil {
+		return storedConfig{}, err
+	}
+	t, _ := time.Parse(time.RFC3339Nano, updated)
+	return storedConfig{Data: data, Revision: strconv.FormatInt(rev, 10), ModTime: t}, nil
+}
+
+func (s *sqliteStore) Put(ctx context.Context, data []byte, rev string) (string, error) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	var (
+		res sql.Result
+		err error
+		cur int64
+	)
+	if rev == "" {
+		res, err = s.db.ExecContext(ctx, `INSERT INTO pipeline_config (id, data, revision, updated_at) VALUES (1, ?, 1, ?) ON CONFLICT (id) DO NOTHING`, data, now)
+	} else {
+		cur, err = strconv.ParseInt(rev, 10, 64)
+		if err != nil {
+			return "", errStoreConflict
+		}
+		res, err = s.db.ExecContext(ctx, `UPDATE pipeline_config SET data = ?, revision = revision + 1, updated_at = ? WHERE id = 1 AND revision = ?`, data, now, cur)
+	}
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return "", errStoreConflict
+	}
+	return strconv.FormatInt(cur+1, 10), nil
+}
+
+func (s *sqliteStore) revision(ctx context.Context) string {
+	var rev int64
+	if err := s.db.QueryRowContext(ctx, `SELECT revision FROM pipeline_config WHERE id = 1`).Scan(&rev); err != nil {
+		return ""
+	}
+	return strconv.FormatInt(rev, 10)
+}
+
+func (s *sqliteStore) Watch(ctx context.Context, onChange func()) error {
+	last := s.revision(ctx)
+	ticker := time.NewTicker(storePollInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if rev := s.revision(ctx); rev != last {
+				last = rev
+				onChange()
+			}
+		}
+	}
+}
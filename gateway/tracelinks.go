@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Link templates for TRACE_UI_KIND. Placeholders: {base}, {trace_id}, {datasource}, {left} (Grafana explore state).
+var traceUITemplates = map[string]string{
+	"jaeger": "{base}/trace/{trace_id}",
+	"zipkin": "{base}/zipkin/traces/{trace_id}",
+	"tempo":  "{base}/explore?orgId=1&left={left}",
+}
+
+// TraceUIConfig describes how to build a link to a trace in an external trace UI.
+type TraceUIConfig struct {
+	Base       string
+	Template   string
+	Datasource string
+}
+
+func loadTraceUIConfig() TraceUIConfig {
+	base := os.Getenv("TRACE_UI_BASE_URL")
+	if base == "" {
+		base = "http://localhost:16686"
+	}
+	kind := strings.ToLower(strings.TrimSpace(os.Getenv("TRACE_UI_KIND")))
+	if kind == "" {
+		kind = "jaeger"
+	}
+	tmpl := os.Getenv("TRACE_UI_LINK_TEMPLATE")
+	if tmpl == "" {
+		tmpl = traceUITemplates[kind]
+	}
+	if tmpl == "" {
+		tmpl = traceUITemplates["jaeger"]
+	}
+	ds := os.Getenv("TRACE_UI_DATASOURCE")
+	if ds == "" {
+		ds = "tempo"
+	}
+	return TraceUIConfig{
+		Base:       strings.TrimRight(base, "/"),
+		Template:   tmpl,
+		Datasource: ds,
+	}
+}
+
+var traceUIConfig = loadTraceUIConfig()
+
+// URL returns the trace UI link for traceID, or "" when the base URL is disabled ("-").
+func (c TraceUIConfig) URL(traceID string) string {
+	if c.Base == "-" || traceID == "" {
+		return ""
+	}
+	left, _ := json.Marshal(map[string]interface{}{
+		"datasource": c.Datasource,
+		"queries": []map[string]string{
+			{"refId": "A", "queryType": "traceql", "query": traceID},
+		},
+		"range": map[string]string{"from": "now-1h", "to": "now"},
+	})
+	return strings.NewReplacer(
+		"{base}", c.Base,
+		"{trace_id}", url.PathEscape(traceID),
+		"{datasource}", url.QueryEscape(c.Datasource),
+		"{left}", url.QueryEscape(string(left)),
+	).Replace(c.Template)
+}
+
+// traceURL returns the configured trace UI link for traceID.
+func traceURL(traceID string) string {
+	return traceUIConfig.URL(traceID)
+}
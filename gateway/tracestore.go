@@ -0,0 +1,396 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// StoredSpan is a finished span kept in the in-process trace store.
+type StoredSpan struct {
+	TraceID       string                 `json:"trace_id"`
+	SpanID        string                 `json:"span_id"`
+	ParentSpanID  string                 `json:"parent_span_id,omitempty"`
+	Name          string                 `json:"name"`
+	Service       string                 `json:"service"`
+	Kind          string                 `json:"kind"`
+	Start         time.Time              `json:"start"`
+	End           time.Time              `json:"end"`
+	Status        string                 `json:"status"`
+	StatusMessage string                 `json:"status_message,omitempty"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// TraceStore keeps the most recent spans in a fixed-size ring buffer, indexed by trace ID.
+type TraceStore struct {
+	mu      sync.RWMutex
+	spans   []StoredSpan
+	next    int
+	full    bool
+	byTrace map[string]int // trace ID -> number of spans currently in the ring
+}
+
+// NewTraceStore creates a trace store holding at most capacity spans.
+func NewTraceStore(capacity int) *TraceStore {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &TraceStore{
+		spans:   make([]StoredSpan, capacity),
+		byTrace: make(map[string]int),
+	}
+}
+
+// Add stores spans, evicting the oldest ones once the buffer is full.
+func (s *TraceStore) Add(spans ...StoredSpan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sp := range spans {
+		if s.full {
+			old := s.spans[s.next].TraceID
+			if s.byTrace[old] <= 1 {
+				delete(s.byTrace, old)
+			} else {
+				s.byTrace[old]--
+			}
+		}
+		s.spans[s.next] = sp
+		s.byTrace[sp.TraceID]++
+		s.next++
+		if s.next == len(s.spans) {
+			s.next = 0
+			s.full = true
+		}
+	}
+}
+
+// Trace returns all stored spans for traceID ordered by start time, or nil if none are stored.
+func (s *TraceStore) Trace(traceID string) []StoredSpan {
+	traceID = strings.ToLower(traceID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := s.byTrace[traceID]
+	if n == 0 {
+		return nil
+	}
+	out := make([]StoredSpan, 0, n)
+	for i := range s.spans {
+		if s.spans[i].TraceID == traceID {
+			out = append(out, s.spans[i])
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+func traceStoreCapacity() int {
+	n, err := strconv.Atoi(os.Getenv("TRACE_STORE_MAX_SPANS"))
+	if err != nil || n <= 0 {
+		return 10000
+	}
+	return n
+}
+
+// traceStoreOTLPIngest returns true when POST /v1/traces should accept spans from the microservices.
+func traceStoreOTLPIngest() bool {
+	v := strings.ToLower(os.Getenv("TRACE_STORE_OTLP_INGEST"))
+	return v == "1" || v == "true" || v == "yes"
+}
+
+var traceStore = NewTraceStore(traceStoreCapacity())
+
+// traceStoreProcessor is a span processor that copies every ended gateway span into a TraceStore.
+type traceStoreProcessor struct {
+	store *TraceStore
+}
+
+func newTraceStoreProcessor(store *TraceStore) *traceStoreProcessor {
+	return &traceStoreProcessor{store: store}
+}
+
+func (p *traceStoreProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (p *traceStoreProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	sc := s.SpanContext()
+	sp := StoredSpan{
+		TraceID:    sc.TraceID().String(),
+		SpanID:     sc.SpanID().String(),
+		Name:       s.Name(),
+		Kind:       s.SpanKind().String(),
+		Start:      s.StartTime(),
+		End:        s.EndTime(),
+		Status:     statusString(s.Status().Code),
+		Attributes: attrsToMap(s.Attributes()),
+	}
+	if s.Parent().IsValid() {
+		sp.ParentSpanID = s.Parent().SpanID().String()
+	}
+	if s.Status().Code == codes.Error {
+		sp.StatusMessage = s.Status().Description
+	}
+	if res := s.Resource(); res != nil {
+		if v, ok := res.Set().Value(semconv.ServiceNameKey); ok {
+			sp.Service = v.AsString()
+		}
+	}
+	p.store.Add(sp)
+}
+
+func (p *traceStoreProcessor) Shutdown(context.Context) error { return nil }
+
+func (p *traceStoreProcessor) ForceFlush(context.Context) error { return nil }
+
+func statusString(c codes.Code) string {
+	switch c {
+	case codes.Ok:
+		return "ok"
+	case codes.Error:
+		return "error"
+	}
+	return "unset"
+}
+
+func attrsToMap(kvs []attribute.KeyValue) map[string]interface{} {
+	if len(kvs) == 0 {
+		return nil
+	}
+	out := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		out[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	return out
+}
+
+// otlpIngest accepts OTLP/HTTP protobuf trace exports (POST /v1/traces) and adds the spans to the trace store.
+func otlpIngest(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/x-protobuf") {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		replyJSON(w, map[string]interface{}{"detail": "Only application/x-protobuf is supported"})
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			replyJSON(w, map[string]interface{}{"detail": err.Error()})
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		replyJSON(w, map[string]interface{}{"detail": err.Error()})
+		return
+	}
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(raw, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		replyJSON(w, map[string]interface{}{"detail": err.Error()})
+		return
+	}
+	traceStore.Add(spansFromOTLP(&req)...)
+	out, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(out)
+}
+
+func spansFromOTLP(req *coltracepb.ExportTraceServiceRequest) []StoredSpan {
+	var out []StoredSpan
+	for _, rs := range req.GetResourceSpans() {
+		service := ""
+		for _, kv := range rs.GetResource().GetAttributes() {
+			if kv.GetKey() == string(semconv.ServiceNameKey) {
+				service = kv.GetValue().GetStringValue()
+			}
+		}
+		for _, ss := range rs.GetScopeSpans() {
+			for _, s := range ss.GetSpans() {
+				sp := StoredSpan{
+					TraceID:    hex.EncodeToString(s.GetTraceId()),
+					SpanID:     hex.EncodeToString(s.GetSpanId()),
+					Name:       s.GetName(),
+					Service:    service,
+					Kind:       otlpKindString(s.GetKind()),
+					Start:      time.Unix(0, int64(s.GetStartTimeUnixNano())),
+					End:        time.Unix(0, int64(s.GetEndTimeUnixNano())),
+					Status:     "unset",
+					Attributes: otlpAttrsToMap(s.GetAttributes()),
+				}
+				if len(s.GetParentSpanId()) > 0 {
+					sp.ParentSpanID = hex.EncodeToString(s.GetParentSpanId())
+				}
+				switch s.GetStatus().GetCode() {
+				case tracepb.Status_STATUS_CODE_OK:
+					sp.Status = "ok"
+				case tracepb.Status_STATUS_CODE_ERROR:
+					sp.Status = "error"
+					sp.StatusMessage = s.GetStatus().GetMessage()
+				}
+				out = append(out, sp)
+			}
+		}
+	}
+	return out
+}
+
+func otlpKindString(k tracepb.Span_SpanKind) string {
+	switch k {
+	case tracepb.Span_SPAN_KIND_INTERNAL:
+		return "internal"
+	case tracepb.Span_SPAN_KIND_SERVER:
+		return "server"
+	case tracepb.Span_SPAN_KIND_CLIENT:
+		return "client"
+	case tracepb.Span_SPAN_KIND_PRODUCER:
+		return "producer"
+	case tracepb.Span_SPAN_KIND_CONSUMER:
+		return "consumer"
+	}
+	return "unspecified"
+}
+
+func otlpAttrsToMap(kvs []*commonpb.KeyValue) map[string]interface{} {
+	if len(kvs) == 0 {
+		return nil
+	}
+	out := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		out[kv.GetKey()] = otlpValue(kv.GetValue())
+	}
+	return out
+}
+
+func otlpValue(v *commonpb.AnyValue) interface{} {
+	switch x := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return x.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return x.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return x.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return x.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return hex.EncodeToString(x.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		arr := make([]interface{}, 0, len(x.ArrayValue.GetValues()))
+		for _, e := range x.ArrayValue.GetValues() {
+			arr = append(arr, otlpValue(e))
+		}
+		return arr
+	case *commonpb.AnyValue_KvlistValue:
+		return otlpAttrsToMap(x.KvlistValue.GetValues())
+	}
+	return nil
+}
+
+// spanNode is one span in the tree returned by GET /api/traces/{traceId}.
+type spanNode struct {
+	StoredSpan
+	DurationMs float64     `json:"duration_ms"`
+	Children   []*spanNode `json:"children"`
+}
+
+// timelineEntry is one span in the flat timeline, with its offset from the start of the trace.
+type timelineEntry struct {
+	SpanID     string  `json:"span_id"`
+	Name       string  `json:"name"`
+	Service    string  `json:"service"`
+	Depth      int     `json:"depth"`
+	OffsetMs   float64 `json:"offset_ms"`
+	DurationMs float64 `json:"duration_ms"`
+	Status     string  `json:"status"`
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// buildSpanTree links spans to their parents. Spans whose parent is not stored become roots.
+func buildSpanTree(spans []StoredSpan) []*spanNode {
+	nodes := make(map[string]*spanNode, len(spans))
+	ordered := make([]*spanNode, len(spans))
+	for i := range spans {
+		n := &spanNode{StoredSpan: spans[i], DurationMs: durationMs(spans[i].End.Sub(spans[i].Start)), Children: []*spanNode{}}
+		nodes[spans[i].SpanID] = n
+		ordered[i] = n
+	}
+	roots := []*spanNode{}
+	for _, n := range ordered {
+		if p, ok := nodes[n.ParentSpanID]; ok && n.ParentSpanID != "" && p != n {
+			p.Children = append(p.Children, n)
+		} else {
+			roots = append(roots, n)
+		}
+	}
+	return roots
+}
+
+func buildTimeline(roots []*spanNode, traceStart time.Time) []timelineEntry {
+	out := []timelineEntry{}
+	var walk func(n *spanNode, depth int)
+	walk = func(n *spanNode, depth int) {
+		out = append(out, timelineEntry{
+			SpanID:     n.SpanID,
+			Name:       n.Name,
+			Service:    n.Service,
+			Depth:      depth,
+			OffsetMs:   durationMs(n.Start.Sub(traceStart)),
+			DurationMs: n.DurationMs,
+			Status:     n.Status,
+		})
+		for _, c := range n.Children {
+			walk(c, depth+1)
+		}
+	}
+	for _, r := range roots {
+		walk(r, 0)
+	}
+	return out
+}
+
+func apiTraceGet(w http.ResponseWriter, r *http.Request) {
+	traceID := chi.URLParam(r, "traceId")
+	spans := traceStore.Trace(traceID)
+	if len(spans) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"detail": "Trace not found"})
+		return
+	}
+	start, end := spans[0].Start, spans[0].End
+	for _, sp := range spans {
+		if sp.End.After(end) {
+			end = sp.End
+		}
+	}
+	roots := buildSpanTree(spans)
+	replyJSON(w, map[string]interface{}{
+		"trace_id":    strings.ToLower(traceID),
+		"start":       start,
+		"duration_ms": durationMs(end.Sub(start)),
+		"span_count":  len(spans),
+		"spans":       roots,
+		"timeline":    buildTimeline(roots, start),
+	})
+}
@@ -13,11 +13,8 @@ import (
 	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 )
 
-func initTracing(ctx context.Context) (func(), error) {
-	serviceName := os.Getenv("OTEL_SERVICE_NAME")
-	if serviceName == "" {
-		serviceName = "gateway"
-	}
+// otlpEndpoint returns OTEL_EXPORTER_OTLP_ENDPOINT as host:port, which is what the OTLP HTTP exporters expect.
+func otlpEndpoint() string {
 	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
 	if endpoint == "" {
 		endpoint = "jaeger:4318"
@@ -32,6 +29,23 @@ func initTracing(ctx context.Context) (func(), error) {
 	if idx := strings.Index(endpoint, "/"); idx >= 0 {
 		endpoint = endpoint[:idx]
 	}
+	return endpoint
+}
+
+// serviceResource is the OTel resource shared by traces and logs.
+func serviceResource() *resource.Resource {
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "gateway"
+	}
+	return resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	)
+}
+
+func initTracing(ctx context.Context) (func(), error) {
+	endpoint := otlpEndpoint()
 
 	exporter, err := otlptracehttp.New(ctx,
 		otlptracehttp.WithEndpoint(endpoint),
@@ -43,10 +57,8 @@ func initTracing(ctx context.Context) (func(), error) {
 
 	provider := sdktrace.NewTracerProvider(
 		sdktrace.WithBatcher(exporter),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceName(serviceName),
-		)),
+		sdktrace.WithSpanProcessor(newTraceStoreProcessor(traceStore)),
+		sdktrace.WithResource(serviceResource()),
 	)
 	otel.SetTracerProvider(provider)
 	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
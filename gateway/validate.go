@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Diagnostic is one finding from validatePipeline. Errors block PUT; warnings do not.
+type Diagnostic struct {
+	Severity string `json:"severity"` // error, warning
+	Check    string `json:"check"`    // name, interpolation, composition, balance, hedge, fallback, on_error, variants, url, discovery, dns, health, types, duplicate_url
+	Service  string `json:"service,omitempty"`
+	Message  string `json:"message"`
+}
+
+// validateOptions selects which checks validatePipeline runs.
+type validateOptions struct {
+	Network bool // DNS resolution and GET /health
+	// API marks services sent to the API: references they add to Existing (the pipeline's current
+	// services) are rejected without being resolved (see newReferences).
+	API      bool
+	Existing []PipelineService
+}
+
+// PipelineValidateRequest is POST /api/pipeline/validate body.
+type PipelineValidateRequest struct {
+	Services []PipelineServiceUpdate `json:"services"`
+	Network  *bool                   `json:"network"`
+	Pipeline string                  `json:"pipeline"` // name the services would be saved as (default pipeline if empty)
+}
+
+// validateNetworkDefault returns false when PIPELINE_VALIDATE_NETWORK=false (no DNS or health checks on writes).
+func validateNetworkDefault() bool {
+	return strings.ToLower(os.Getenv("PIPELINE_VALIDATE_NETWORK")) != "false"
+}
+
+func hasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == "error" {
+			return true
+		}
+	}
+	return false
+}
+
+// firstError returns the message of the first error diagnostic.
+func firstError(diags []Diagnostic) string {
+	for _, d := range diags {
+		if d.Severity == "error" {
+			if d.Service != "" {
+				return d.Service + ": " + d.Message
+			}
+			return d.Message
+		}
+	}
+	return ""
+}
+
+// validatePipeline checks names, input/output type compatibility, ${...} references, URL syntax and duplicate
+// URLs, and with opts.Network also DNS resolution and /health reachability (in parallel). It never changes
+// the config.
+func validatePipeline(ctx context.Context, svc []PipelineService, opts validateOptions) []Diagnostic {
+	diags := []Diagnostic{}
+	if len(svc) == 0 {
+		return append(diags, Diagnostic{Severity: "error", Check: "name", Message: "At least one service required"})
+	}
+	names := map[string]bool{}
+	urls := map[string]string{}
+	var targets []netTarget
+	for i, s := range svc {
+		if s.Name == "" {
+			diags = append(diags, Diagnostic{Severity: "error", Check: "name", Message: fmt.Sprintf("Service %d: name is required", i+1)})
+		} else if names[s.Name] {
+			diags = append(diags, Diagnostic{Severity: "error", Check: "name", Service: s.Name, Message: "Duplicate service name"})
+		}
+		names[s.Name] = true
+
+		if i > 0 {
+			prev := svc[i-1]
+			if !typesCompatible(prev.OutputType, s.InputType) {
+				diags = append(diags, Diagnostic{
+					Severity: "error",
+					Check:    "types",
+					Service:  s.Name,
+					Message:  fmt.Sprintf("Input type %q does not match output type %q of %s", s.InputType, prev.OutputType, prev.Name),
+				})
+			}
+		}
+
+		if opts.API {
+			if fields := newReferences(s, opts.Existing); len(fields) > 0 {
+				diags = append(diags, Diagnostic{Severity: "error", Check: "interpolation", Service: s.Name, Message: "${...} references can only be added in the config file: " + strings.Join(fields, ", ")})
+				continue
+			}
+		}
+		rs, err := resolveService(s)
+		if err != nil {
+			diags = append(diags, Diagnostic{Severity: "error", Check: "interpolation", Service: s.Name, Message: err.Error()})
+			continue
+		}
+		// Messages about a service with references must not show what they resolved to.
+		redact := len(referenceFields(s)) > 0
+		if isComposite(rs) {
+			if msg := checkComposite(rs); msg != "" {
+				diags = append(diags, Diagnostic{Severity: "error", Check: "composition", Service: s.Name, Message: msg})
+			}
+			continue
+		}
+		if !validBalance(rs.Balance) {
+			diags = append(diags, Diagnostic{Severity: "error", Check: "balance", Service: s.Name, Message: "Unknown balance strategy: " + rs.Balance})
+		} else if rs.Balance == balanceConsistentHash && rs.HashKey == "" {
+			diags = append(diags, Diagnostic{Severity: "warning", Check: "balance", Service: s.Name, Message: "consistent_hash without hash_key; calls are spread round robin"})
+		}
+		if rs.Hedge != nil {
+			if msg := rs.Hedge.check(); msg != "" {
+				diags = append(diags, Diagnostic{Severity: "error", Check: "hedge", Service: s.Name, Message: msg})
+			}
+		}
+		if rs.Fallback != nil {
+			if msg := rs.Fallback.check(); msg != "" {
+				diags = append(diags, Diagnostic{Severity: "error", Check: "fallback", Service: s.Name, Message: msg})
+			} else if u := rs.Fallback.URL; isDiscoveryURL(u) {
+				diags = append(diags, discoveryDiagnostics(ctx, s.Name, u, opts)...)
+			} else if u != "" {
+				if parsed, msg := checkServiceURL(u); msg != "" {
+					diags = append(diags, Diagnostic{Severity: "error", Check: "url", Service: s.Name, Message: "Fallback: " + msg})
+				} else {
+					targets = append(targets, netTarget{service: s.Name, redact: redact, url: u, parsed: parsed})
+				}
+			}
+		}
+		if !validOnError(rs.OnError) {
+			diags = append(diags, Diagnostic{Severity: "error", Check: "on_error", Service: s.Name, Message: "Unknown on_error policy: " + rs.OnError})
+		}
+		for _, msg := range checkVariants(rs) {
+			diags = append(diags, Diagnostic{Severity: "error", Check: "variants", Service: s.Name, Message: msg})
+		}
+		endpoints := rs.endpointURLs()
+		if len(endpoints) == 0 && len(rs.Variants) == 0 {
+			endpoints = []string{""}
+		}
+		for _, ep := range endpoints {
+			if isDiscoveryURL(ep) {
+				diags = append(diags, discoveryDiagnostics(ctx, s.Name, ep, opts)...)
+				continue
+			}
+			u, msg := checkServiceURL(ep)
+			if msg != "" {
+				diags = append(diags, Diagnostic{Severity: "error", Check: "url", Service: s.Name, Message: msg})
+				continue
+			}
+			targets = append(targets, netTarget{service: s.Name, redact: redact, url: ep, parsed: u})
+			if other, ok := urls[ep]; ok {
+				diags = append(diags, Diagnostic{Severity: "warning", Check: "duplicate_url", Service: s.Name, Message: "Same URL as " + other})
+			} else {
+				urls[ep] = s.Name
+			}
+		}
+		for _, v := range rs.Variants {
+			if isDiscoveryURL(v.URL) {
+				diags = append(diags, discoveryDiagnostics(ctx, s.Name, v.URL, opts)...)
+				continue
+			}
+			u, msg := checkServiceURL(v.URL)
+			if msg != "" {
+				diags = append(diags, Diagnostic{Severity: "error", Check: "url", Service: s.Name, Message: "Variant " + v.Name + ": " + msg})
+				continue
+			}
+			targets = append(targets, netTarget{service: s.Name, redact: redact, url: v.URL, parsed: u})
+		}
+		if rs.Shadow != "" {
+			if u, msg := checkServiceURL(rs.Shadow); msg != "" {
+				diags = append(diags, Diagnostic{Severity: "error", Check: "url", Service: s.Name, Message: "Shadow: " + msg})
+			} else {
+				targets = append(targets, netTarget{service: s.Name, redact: redact, url: rs.Shadow, parsed: u})
+			}
+		}
+		if u := rs.Compensate; isDiscoveryURL(u) {
+			diags = append(diags, discoveryDiagnostics(ctx, s.Name, u, opts)...)
+		} else if u != "" {
+			// Not a network target: a compensate URL is often a path of the service, without /health.
+			if _, msg := checkServiceURL(u); msg != "" {
+				diags = append(diags, Diagnostic{Severity: "error", Check: "url", Service: s.Name, Message: "Compensate: " + msg})
+			}
+		}
+	}
+	if opts.Network {
+		diags = append(diags, networkDiagnostics(ctx, targets)...)
+	}
+	return diags
+}
+
+// checkComposite checks the form of a pipeline/include entry. Whether the target exists (and has no
+// cycles) is checked when the config is resolved, which needs the whole pipeline set.
+func checkComposite(s PipelineService) string {
+	if s.Pipeline != "" && s.Include != "" {
+		return "pipeline and include cannot both be set"
+	}
+	if s.URL != "" || len(s.Endpoints) > 0 {
+		return "A pipeline or include entry cannot have a URL"
+	}
+	if len(s.Variants) > 0 || s.Shadow != "" || s.Hedge != nil || s.Fallback != nil || s.OnError != "" || s.Compensate != "" {
+		return "A pipeline or include entry cannot have variants, a shadow, hedging, a fallback, on_error or compensate"
+	}
+	return ""
+}
+
+// checkVariants returns what is wrong with the variants of s: names must be unique and not "primary",
+// weights not negative, and with a url or endpoints of its own the weights may add up to at most 100.
+func checkVariants(s PipelineService) []string {
+	var msgs []string
+	seen := map[string]bool{}
+	total := 0
+	for i, v := range s.Variants {
+		switch {
+		case v.Name == "":
+			msgs = append(msgs, fmt.Sprintf("Variant %d: name is required", i+1))
+		case v.Name == primaryVariant:
+			msgs = append(msgs, "Variant name \"primary\" is reserved for the service's own url")
+		case seen[v.Name]:
+			msgs = append(msgs, "Duplicate variant name: "+v.Name)
+		}
+		seen[v.Name] = true
+		if v.Weight < 0 {
+			msgs = append(msgs, "Variant "+v.Name+": weight must not be negative")
+		}
+		if v.Match == nil {
+			total += v.Weight
+		}
+	}
+	if total > 100 && (s.URL != "" || len(s.Endpoints) > 0) {
+		msgs = append(msgs, fmt.Sprintf("Variant weights add up to %d%%; at most 100%% is allowed", total))
+	}
+	return msgs
+}
+
+// checkServiceURL returns the parsed URL, or a message describing why it is not a usable base URL.
+func checkServiceURL(raw string) (*url.URL, string) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, "URL is required"
+	}
+	// Messages do not quote raw: it may be the resolved value of a reference.
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, "Malformed URL"
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, "URL scheme must be http or https"
+	}
+	if u.Hostname() == "" {
+		return nil, "URL has no host"
+	}
+	if p := u.Port(); p != "" {
+		if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+			return nil, "Invalid port"
+		}
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, "URL must not contain a query or fragment"
+	}
+	return u, ""
+}
+
+// typesCompatible treats empty and "any" as matching every type.
+func typesCompatible(out, in string) bool {
+	out, in = strings.ToLower(strings.TrimSpace(out)), strings.ToLower(strings.TrimSpace(in))
+	if out == "" || out == "any" || in == "" || in == "any" {
+		return true
+	}
+	return out == in
+}
+
+// discoveryDiagnostics checks a discovery URL's syntax and, with opts.Network, that it lists endpoints now.
+func discoveryDiagnostics(ctx context.Context, service, raw string, opts validateOptions) []Diagnostic {
+	spec, err := parseDiscoveryURL(raw)
+	if err != nil {
+		return []Diagnostic{{Severity: "error", Check: "url", Service: service, Message: err.Error()}}
+	}
+	if spec.kind == "registry" {
+		// Registered instances are known locally; a service may simply not have started yet.
+		if len(registry.urls(spec.name)) == 0 {
+			return []Diagnostic{{Severity: "warning", Check: "discovery", Service: service, Message: "No live registrations for " + spec.name}}
+		}
+		return nil
+	}
+	if !opts.Network {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	urls, err := spec.lookup(ctx)
+	if err != nil {
+		// Not err: file errors quote the file.
+		logger.WarnContext(ctx, "discovery check failed", "service", service, "error", err)
+		return []Diagnostic{{Severity: "error", Check: "discovery", Service: service, Message: "Discovery failed"}}
+	}
+	if len(urls) == 0 {
+		return []Diagnostic{{Severity: "warning", Check: "discovery", Service: service, Message: "Discovery source lists no endpoints"}}
+	}
+	return nil
+}
+
+// netTarget is one syntactically valid endpoint URL to check over the network.
+type netTarget struct {
+	service string
+	url     string
+	parsed  *url.URL
+	redact  bool // the URL came from a reference; keep it out of messages
+}
+
+// networkDiagnostics resolves each host and calls GET <url>/health, one goroutine per endpoint.
+// DNS failures are errors; an unhealthy or unreachable /health is a warning (the service may just be down).
+func networkDiagnostics(ctx context.Context, targets []netTarget) []Diagnostic {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	client := &http.Client{Timeout: 2 * time.Second}
+	results := make([][]Diagnostic, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			t, u := targets[i], targets[i].parsed
+			if net.ParseIP(u.Hostname()) == nil {
+				if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+					msg := "Cannot resolve " + u.Hostname() + ": " + err.Error()
+					if t.redact {
+						msg = "Cannot resolve host"
+					}
+					results[i] = append(results[i], Diagnostic{Severity: "error", Check: "dns", Service: t.service, Message: msg})
+					return
+				}
+			}
+			req, err := http.NewRequestWithContext(ctx, "GET", t.url+"/health", nil)
+			if err != nil {
+				results[i] = append(results[i], Diagnostic{Severity: "warning", Check: "health", Service: t.service, Message: "Invalid health check URL"})
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				msg := "Health check failed: " + err.Error()
+				if t.redact {
+					msg = "Health check failed"
+				}
+				results[i] = append(results[i], Diagnostic{Severity: "warning", Check: "health", Service: t.service, Message: msg})
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				results[i] = append(results[i], Diagnostic{Severity: "warning", Check: "health", Service: t.service, Message: "Health check returned HTTP " + strconv.Itoa(resp.StatusCode)})
+			}
+		}(i)
+	}
+	wg.Wait()
+	var out []Diagnostic
+	for _, r := range results {
+		out = append(out, r...)
+	}
+	return out
+}
+
+// skipValidation reports whether the request opted out of validation with ?validate=false.
+func skipValidation(r *http.Request) bool {
+	return strings.ToLower(r.URL.Query().Get("validate")) == "false"
+}
+
+// validateForWrite runs the PUT-time validation of svc, to be saved as pipeline name (the default if
+// empty), and writes a rejection when it finds errors. Returns false if the write must not proceed.
+func validateForWrite(w http.ResponseWriter, r *http.Request, name string, svc []PipelineService) bool {
+	if skipValidation(r) {
+		return true
+	}
+	opts := validateOptions{Network: validateNetworkDefault(), API: true, Existing: currentServices(name)}
+	diags := validatePipeline(r.Context(), svc, opts)
+	if hasErrors(diags) {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": firstError(diags), "diagnostics": diags})
+		return false
+	}
+	return true
+}
+
+// currentServices returns the saved services of pipeline name (the default if empty), nil if it does not
+// exist.
+func currentServices(name string) []PipelineService {
+	ps := loadPipelineSet()
+	if name == "" {
+		name = ps.Default
+	}
+	return ps.Pipelines[name]
+}
+
+func apiPipelineValidate(w http.ResponseWriter, r *http.Request) {
+	var body PipelineValidateRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Invalid JSON"})
+		return
+	}
+	svc := make([]PipelineService, 0, len(body.Services))
+	for _, s := range body.Services {
+		svc = append(svc, serviceFromUpdate(s))
+	}
+	opts := validateOptions{Network: true, API: true, Existing: currentServices(body.Pipeline)}
+	if body.Network != nil {
+		opts.Network = *body.Network
+	}
+	diags := validatePipeline(r.Context(), svc, opts)
+	if !hasErrors(diags) {
+		// Pipeline references and includes only resolve against the rest of the config.
+		ps := loadPipelineSet()
+		name := body.Pipeline
+		if name == "" {
+			name = ps.Default
+		}
+		ps.Pipelines[name] = svc
+		if err := ps.resolve(); err != nil {
+			diags = append(diags, Diagnostic{Severity: "error", Check: "composition", Message: err.Error()})
+		}
+	}
+	replyJSON(w, map[string]interface{}{
+		"ok":          !hasErrors(diags),
+		"diagnostics": diags,
+		"services":    pipelineServicesOut(svc),
+	})
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var errVersionNotFound = errors.New("pipeline version not found")
+
+// PipelineVersion is one entry in the pipeline config history. Config is the full config after the change.
+type PipelineVersion struct {
+	Version      int             `json:"version"`
+	Author       string          `json:"author"`
+	SelfAsserted bool            `json:"author_self_asserted,omitempty"` // author from X-Author, not verified
+	Timestamp    time.Time       `json:"timestamp"`
+	Action       string          `json:"action"` // initial, update, delete, rollback, reload
+	Pipeline     string          `json:"pipeline,omitempty"`
+	RollbackOf   int             `json:"rollback_of,omitempty"`
+	Diff         []configDiff    `json:"diff"`
+	Config       *pipelineConfig `json:"config,omitempty"`
+}
+
+// versionChange describes who changed what; commitPipelineSet turns it into a PipelineVersion.
+type versionChange struct {
+	Action       string
+	Pipeline     string
+	Author       string
+	SelfAsserted bool
+	RollbackOf   int
+}
+
+// configDiff is one difference between two pipeline sets.
+type configDiff struct {
+	Op       string `json:"op"` // add, remove, change, reorder, default
+	Pipeline string `json:"pipeline"`
+	Service  string `json:"service,omitempty"`
+	Field    string `json:"field,omitempty"`
+	Old      string `json:"old,omitempty"`
+	New      string `json:"new,omitempty"`
+}
+
+// versionHistory stores PipelineVersions in memory, or as JSON lines in a file shared by all replicas.
+type versionHistory struct {
+	mu  sync.Mutex
+	mem []PipelineVersion
+}
+
+var pipelineHistory = &versionHistory{}
+
+// historyPath returns PIPELINE_HISTORY_PATH, else "<file>.history.jsonl" next to the file or SQLite
+// config store, else "" (memory only; set PIPELINE_HISTORY_PATH with the consul and etcd stores).
+func historyPath() string {
+	if p := os.Getenv("PIPELINE_HISTORY_PATH"); p != "" {
+		return p
+	}
+	switch st := configStore.(type) {
+	case *fileStore:
+		return st.path + ".history.jsonl"
+	case *sqliteStore:
+		return st.path + ".history.jsonl"
+	}
+	return ""
+}
+
+// List returns all versions, oldest first.
+func (h *versionHistory) List() ([]PipelineVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	path := historyPath()
+	if path == "" {
+		out := make([]PipelineVersion, len(h.mem))
+		copy(out, h.mem)
+		return out, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []PipelineVersion
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var pv PipelineVersion
+		if err := json.Unmarshal([]byte(line), &pv); err != nil {
+			logger.Warn("skipping unreadable pipeline history entry", "path", path, "error", err)
+			continue
+		}
+		out = append(out, pv)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, sc.Err()
+}
+
+// Get returns version v.
+func (h *versionHistory) Get(v int) (PipelineVersion, error) {
+	all, err := h.List()
+	if err != nil {
+		return PipelineVersion{}, err
+	}
+	for _, pv := range all {
+		if pv.Version == v {
+			return pv, nil
+		}
+	}
+	return PipelineVersion{}, errVersionNotFound
+}
+
+// Latest returns the highest recorded version, or 0 if the history is empty.
+func (h *versionHistory) Latest() (int, error) {
+	all, err := h.List()
+	if err != nil || len(all) == 0 {
+		return 0, err
+	}
+	return all[len(all)-1].Version, nil
+}
+
+// Append records pv.
+func (h *versionHistory) Append(pv PipelineVersion) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	path := historyPath()
+	if path == "" {
+		h.mem = append(h.mem, pv)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	line, err := json.Marshal(pv)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// commitPipelineSet assigns ps the next version, saves it, and records the change in the history.
+// The first change also records the config it replaces, so it can be rolled back to.
+// Caller must hold the config lock (see withConfigLock).
+func commitPipelineSet(old, ps *pipelineSet, change versionChange) (commitResult, error) {
+	latest, err := pipelineHistory.Latest()
+	if err != nil {
+		return commitResult{}, err
+	}
+	now := time.Now().UTC()
+	if latest == 0 {
+		oldCfg := old.toConfig()
+		if err := pipelineHistory.Append(PipelineVersion{
+			Version:   old.Version,
+			Author:    "system",
+			Timestamp: now,
+			Action:    "initial",
+			Diff:      []configDiff{},
+			Config:    &oldCfg,
+		}); err != nil {
+			return commitResult{}, err
+		}
+		latest = old.Version
+	}
+	if old.Version > latest {
+		latest = old.Version
+	}
+	ps.Version = latest + 1
+	ps.rev = old.rev
+	if err := savePipelineSet(ps); err != nil {
+		return commitResult{}, err
+	}
+	cfg := ps.toConfig()
+	pv := PipelineVersion{
+		Version:      ps.Version,
+		Author:       change.Author,
+		SelfAsserted: change.SelfAsserted,
+		Timestamp:    now,
+		Action:       change.Action,
+		Pipeline:     change.Pipeline,
+		RollbackOf:   change.RollbackOf,
+		Diff:         diffPipelineSets(old, ps),
+		Config:       &cfg,
+	}
+	if err := pipelineHistory.Append(pv); err != nil {
+		logger.Error("failed to record pipeline version", "version", ps.Version, "error", err)
+	}
+	configEvents.Publish(ps, change.Action)
+	return commitResult{Version: ps.Version, ETag: pipelineETag(ps)}, nil
+}
+
+// RollbackPipeline restores the config of version v as a new version.
+func RollbackPipeline(v int, meta ChangeMeta) (commitResult, error) {
+	var res commitResult
+	err := withConfigLock(func() error {
+		old := loadPipelineSet()
+		if !etagMatches(meta.IfMatch, pipelineETag(old)) {
+			return errPreconditionFailed
+		}
+		pv, err := pipelineHistory.Get(v)
+		if err != nil {
+			return err
+		}
+		if pv.Config == nil {
+			return errVersionNotFound
+		}
+		ps := pv.Config.toSet()
+		if ps == nil {
+			return errors.New("version has no services")
+		}
+		res, err = commitPipelineSet(old, ps, versionChange{Action: "rollback", Author: meta.Author, SelfAsserted: meta.SelfAsserted, RollbackOf: v})
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	logger.Info("pipeline config rolled back", "to", v, "version", res.Version, "author", meta.Author)
+	return res, nil
+}
+
+// diffPipelineSets lists pipelines and services added, removed, changed or reordered between a and b.
+func diffPipelineSets(a, b *pipelineSet) []configDiff {
+	out := []configDiff{}
+	if a.Default != b.Default {
+		out = append(out, configDiff{Op: "default", Old: a.Default, New: b.Default})
+	}
+	names := map[string]bool{}
+	for n := range a.Pipelines {
+		names[n] = true
+	}
+	for n := range b.Pipelines {
+		names[n] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+	for _, p := range sorted {
+		as, inA := a.Pipelines[p]
+		bs, inB := b.Pipelines[p]
+		switch {
+		case !inA:
+			out = append(out, configDiff{Op: "add", Pipeline: p})
+		case !inB:
+			out = append(out, configDiff{Op: "remove", Pipeline: p})
+		default:
+			out = append(out, diffServices(p, as, bs)...)
+		}
+	}
+	return out
+}
+
+func diffServices(pipeline string, a, b []PipelineService) []configDiff {
+	var out []configDiff
+	byName := func(svc []PipelineService) map[string]PipelineService {
+		m := make(map[string]PipelineService, len(svc))
+		for _, s := range svc {
+			m[s.Name] = s
+		}
+		return m
+	}
+	am, bm := byName(a), byName(b)
+	var aOrder, bOrder []string
+	for _, s := range a {
+		if bs, ok := bm[s.Name]; !ok {
+			out = append(out, configDiff{Op: "remove", Pipeline: pipeline, Service: s.Name})
+		} else {
+			aOrder = append(aOrder, s.Name)
+			out = append(out, diffServiceFields(pipeline, s, bs)...)
+		}
+	}
+	for _, s := range b {
+		if _, ok := am[s.Name]; !ok {
+			out = append(out, configDiff{Op: "add", Pipeline: pipeline, Service: s.Name})
+		} else {
+			bOrder = append(bOrder, s.Name)
+		}
+	}
+	if strings.Join(aOrder, ",") != strings.Join(bOrder, ",") {
+		out = append(out, configDiff{Op: "reorder", Pipeline: pipeline, Old: strings.Join(aOrder, ","), New: strings.Join(bOrder, ",")})
+	}
+	return out
+}
+
+// diffServiceFields compares services field by field using their JSON form, so new fields are diffed automatically.
+func diffServiceFields(pipeline string, a, b PipelineService) []configDiff {
+	var out []configDiff
+	toMap := func(s PipelineService) map[string]interface{} {
+		var m map[string]interface{}
+		raw, _ := json.Marshal(s)
+		_ = json.Unmarshal(raw, &m)
+		return m
+	}
+	am, bm := toMap(a), toMap(b)
+	keys := map[string]bool{}
+	for k := range am {
+		keys[k] = true
+	}
+	for k := range bm {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		av, bv := diffValue(am[k]), diffValue(bm[k])
+		if av != bv {
+			out = append(out, configDiff{Op: "change", Pipeline: pipeline, Service: a.Name, Field: k, Old: av, New: bv})
+		}
+	}
+	return out
+}
+
+func diffValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	raw, _ := json.Marshal(v)
+	return string(raw)
+}
+
+// requestAuthor identifies who made a config change: the identity from the auth proxy's header, or the
+// basic-auth user when BAGGAGE_IDENTITY_BASIC_AUTH allows it (see BaggageConfig). Otherwise it is the
+// X-Author header, which any client can set (selfAsserted is true), else "anonymous".
+func requestAuthor(r *http.Request) (author string, selfAsserted bool) {
+	if h := baggageConfig.IdentityHeader; h != "" {
+		if v := strings.TrimSpace(r.Header.Get(h)); v != "" {
+			return v, false
+		}
+	} else if user, _, ok := r.BasicAuth(); ok && user != "" && baggageConfig.IdentityBasicAuth {
+		return user, false
+	}
+	if v := strings.TrimSpace(r.Header.Get("X-Author")); v != "" {
+		return v, true
+	}
+	return "anonymous", false
+}
+
+// changeMetaFromRequest returns the author and If-Match precondition of a config change request.
+func changeMetaFromRequest(r *http.Request) ChangeMeta {
+	author, selfAsserted := requestAuthor(r)
+	return ChangeMeta{Author: author, SelfAsserted: selfAsserted, IfMatch: r.Header.Get("If-Match")}
+}
+
+func apiPipelineVersions(w http.ResponseWriter, r *http.Request) {
+	all, err := pipelineHistory.List()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		replyJSON(w, map[string]interface{}{"detail": err.Error()})
+		return
+	}
+	out := make([]PipelineVersion, 0, len(all))
+	for i := len(all) - 1; i >= 0; i-- {
+		pv := all[i]
+		pv.Config = nil
+		out = append(out, pv)
+	}
+	replyJSON(w, map[string]interface{}{"current": loadPipelineSet().Version, "versions": out})
+}
+
+func apiPipelineVersionGet(w http.ResponseWriter, r *http.Request) {
+	v, err := strconv.Atoi(chi.URLParam(r, "v"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		replyJSON(w, map[string]interface{}{"detail": "Invalid version"})
+		return
+	}
+	pv, err := pipelineHistory.Get(v)
+	if errors.Is(err, errVersionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"detail": "Version not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		replyJSON(w, map[string]interface{}{"detail": err.Error()})
+		return
+	}
+	replyJSON(w, pv)
+}
+
+func apiPipelineRollback(w http.ResponseWriter, r *http.Request) {
+	if !requireIfMatch(w, r) {
+		return
+	}
+	v, err := strconv.Atoi(chi.URLParam(r, "v"))
+	if err != nil {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Invalid version"})
+		return
+	}
+	res, err := RollbackPipeline(v, changeMetaFromRequest(r))
+	if errors.Is(err, errVersionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": "Version not found"})
+		return
+	}
+	if replyPreconditionFailed(w, err) {
+		return
+	}
+	if err != nil {
+		replyJSON(w, map[string]interface{}{"ok": false, "detail": err.Error()})
+		return
+	}
+	w.Header().Set("ETag", res.ETag)
+	replyJSON(w, map[string]interface{}{"ok": true, "version": res.Version, "saved": storeAuthoritative()})
+}
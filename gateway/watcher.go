@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// PipelineChange is the data of a pipeline_changed event on GET /api/pipeline/events.
+type PipelineChange struct {
+	Version   int      `json:"version"`
+	ETag      string   `json:"etag"`
+	Source    string   `json:"source"` // reload (file edited), or the API action (update, delete, rollback)
+	Default   string   `json:"default"`
+	Pipelines []string `json:"pipelines"`
+}
+
+// configEventHub fans pipeline changes out to SSE subscribers. Changes with the ETag of the last
+// published one are dropped, so an API write followed by the watcher seeing that same file is one event.
+type configEventHub struct {
+	mu       sync.Mutex
+	subs     map[chan PipelineChange]struct{}
+	lastETag string
+}
+
+var configEvents = &configEventHub{subs: make(map[chan PipelineChange]struct{})}
+
+func (h *configEventHub) Subscribe() (<-chan PipelineChange, func()) {
+	ch := make(chan PipelineChange, 4)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// Publish sends ps to all subscribers unless it is unchanged. Slow subscribers miss events rather than
+// block config writes. Returns whether an event was published.
+func (h *configEventHub) Publish(ps *pipelineSet, source string) bool {
+	etag := pipelineETag(ps)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if etag == h.lastETag {
+		return false
+	}
+	h.lastETag = etag
+	ev := PipelineChange{Version: ps.Version, ETag: etag, Source: source, Default: ps.Default, Pipelines: ps.names()}
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	return true
+}
+
+// startConfigWatcher reloads the pipeline config when it changes, unless PIPELINE_WATCH=false: through
+// the config store's Watch when there is one, else by watching PIPELINE_CONFIG_PATH.
+func startConfigWatcher(ctx context.Context) (func(), error) {
+	if strings.ToLower(os.Getenv("PIPELINE_WATCH")) == "false" {
+		return func() {}, nil
+	}
+	configEvents.mu.Lock()
+	configEvents.lastETag = pipelineETag(loadPipelineSet())
+	configEvents.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	if configStore != nil {
+		go func() {
+			if err := configStore.Watch(ctx, reloadFromStore); err != nil {
+				logger.Warn("pipeline config store watch stopped", "store", configStore.Kind(), "error", err)
+			}
+		}()
+		logger.Info("watching pipeline config", "store", configStore.Kind(), "location", configStore.Location())
+		return cancel, nil
+	}
+	path := filepath.Clean(getConfigPath())
+	if err := watchFile(ctx, path, func() { reloadPipelineConfig(path) }); err != nil {
+		cancel()
+		return func() {}, err
+	}
+	logger.Info("watching pipeline config", "path", path)
+	return cancel, nil
+}
+
+// watchFile calls onChange (debounced) when path changes, until ctx is done. It watches the parent
+// directory so atomic renames and Kubernetes ConfigMap symlink swaps are seen.
+func watchFile(ctx context.Context, path string, onChange func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return err
+	}
+	go func() {
+		defer w.Close()
+		var debounce *time.Timer
+		base := filepath.Base(path)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Base(ev.Name)
+				if name != base && !strings.HasPrefix(name, "..") {
+					continue
+				}
+				// Editors and atomic writes produce bursts of events; reload once they settle.
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(250*time.Millisecond, onChange)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("pipeline config watcher error", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadFromStore re-reads the config store after its Watch fired. The regular cached load does the
+// work, including keeping the last good config on errors.
+func reloadFromStore() {
+	configMu.Lock()
+	storeStale = true
+	configMu.Unlock()
+	if configEvents.Publish(loadPipelineSet(), "reload") {
+		logger.Info("pipeline config reloaded", "store", configStore.Kind(), "location", configStore.Location())
+	}
+}
+
+// reloadPipelineConfig picks up an edited PIPELINE_CONFIG_PATH when there is no config store. The file is
+// parsed and validated and, if it differs, committed as a "reload" version replacing the in-memory config.
+func reloadPipelineConfig(path string) {
+	ps, src, err := readPipelineSource(path, "configured")
+	if err == nil {
+		err = validatePipelineSet(ps)
+	}
+	if err != nil {
+		setReloadError(err.Error())
+		logger.Error("pipeline config reload failed; keeping last good config", "path", path, "error", err)
+		return
+	}
+	var res commitResult
+	err = withConfigLock(func() error {
+		old := loadPipelineSet()
+		if len(diffPipelineSets(old, ps)) == 0 {
+			return nil
+		}
+		var err error
+		res, err = commitPipelineSet(old, ps, versionChange{Action: "reload", Author: "file"})
+		if err == nil {
+			configMu.Lock()
+			configSource = src
+			configMu.Unlock()
+		}
+		return err
+	})
+	if err != nil {
+		logger.Error("pipeline config reload failed", "path", path, "error", err)
+		return
+	}
+	if res.Version != 0 {
+		logger.Info("pipeline config reloaded", "path", path, "version", res.Version)
+	}
+}
+
+// apiPipelineEvents streams pipeline_changed events so open dashboards can refetch the config.
+func apiPipelineEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher, _ := w.(http.Flusher)
+	ch, unsubscribe := configEvents.Subscribe()
+	defer unsubscribe()
+	if flusher != nil {
+		flusher.Flush()
+	}
+	keepalive := time.NewTicker(25 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			writeSSE(w, "pipeline_changed", ev)
+		case <-keepalive.C:
+			_, _ = w.Write([]byte(": keepalive\n\n"))
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}